@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	cli "github.com/codegangsta/cli"
+	rw "github.com/dms3-why/dms3gx-go/rewrite"
+)
+
+var CheckCommand = cli.Command{
+	Name:  "check",
+	Usage: "check that every import is declared in package.json",
+	Description: `scans the go files of the current package and reports every import that
+does not resolve to a dependency declared in package.json:
+
+  undeclared       a dms3gx hash path not found in the dependency tree
+  transitive-only  a package only depended on through another dependency
+  unknown          a non standard library path no dependency provides
+
+Exits with an error if any are found, so that it can be used in CI. Also
+available as 'dms3gx-go hook check'.`,
+	Action: func(c *cli.Context) error {
+		return checkImports(os.Stdout)
+	},
+}
+
+var checkHookCommand = cli.Command{
+	Name:  "check",
+	Usage: "hook called to check the imports of a package against its dependencies",
+	Action: func(c *cli.Context) error {
+		return checkImports(os.Stdout)
+	},
+}
+
+// importProblem is an import that does not resolve to a direct dependency
+type importProblem struct {
+	rw.Import
+	Kind string
+
+	// Dep is the package providing the import, for transitive-only ones
+	Dep *depNode
+}
+
+// checkImports reports the import problems of the package we are run in
+// to w, failing if there are any.
+func checkImports(w io.Writer) error {
+	g, err := loadRootDepGraph()
+	if err != nil {
+		return err
+	}
+
+	probs, err := g.importProblems()
+	if err != nil {
+		return err
+	}
+
+	for _, p := range probs {
+		fmt.Fprintf(w, "%s:%d: %s: %s", p.File, p.Pos.Line, p.Path, p.Kind)
+		if p.Dep != nil {
+			fmt.Fprintf(w, " (provided by %s)", p.Dep)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(probs) > 0 {
+		return fmt.Errorf("found %d problematic imports", len(probs))
+	}
+	return nil
+}
+
+// importProblems resolves every non standard library import of the root
+// package against its dependencies, by dms3gx and by dvcs import path.
+func (g *depGraph) importProblems() ([]importProblem, error) {
+	direct := new(rw.PrefixMap)
+	transitive := new(rw.PrefixMap)
+
+	isDirect := make(map[string]bool)
+	for _, h := range g.Root.Deps {
+		isDirect[h] = true
+	}
+
+	for _, n := range g.sortedNodes() {
+		m := transitive
+		if isDirect[n.Hash] {
+			m = direct
+		}
+		m.Add(dms3gxImport(n.Hash, n.Name), n.Hash)
+		if n.DvcsImport != "" {
+			m.Add(n.DvcsImport, n.Hash)
+		}
+	}
+
+	// imports of the package itself
+	if g.Root.DvcsImport != "" {
+		direct.Add(g.Root.DvcsImport, "")
+	}
+
+	imps, _, err := rw.ListImports(g.Root.Dir, goFileFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	var probs []importProblem
+	for _, imp := range imps {
+		if _, _, ok := direct.Match(imp.Path); ok {
+			continue
+		}
+
+		if _, h, ok := transitive.Match(imp.Path); ok {
+			probs = append(probs, importProblem{Import: imp, Kind: "transitive-only", Dep: g.Nodes[h]})
+			continue
+		}
+
+		switch {
+		case isDms3gxImport(imp.Path):
+			probs = append(probs, importProblem{Import: imp, Kind: "undeclared"})
+		case pathIsNotStdlib(imp.Path):
+			probs = append(probs, importProblem{Import: imp, Kind: "unknown"})
+		}
+	}
+
+	return probs, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+	. "github.com/whyrusleeping/stump"
+)
+
+// Layout settings shared by every command. They may be set by the
+// 'namespace' and 'vendordir' fields of the dms3gx section of the root
+// package.json, which are in turn overridden by the environment variables
+// below.
+var (
+	// namespace is the import path prefix dms3gx packages are installed
+	// under, as in '<namespace>/<hash>/<name>'
+	namespace = "dms3gx/dms3fs"
+
+	// vendorRoot is the directory within a package holding its locally
+	// installed dependencies
+	vendorRoot = "vendor"
+
+	// vendorDir is the directory within a package holding its locally
+	// installed dms3gx packages
+	vendorDir = filepath.Join(vendorRoot, filepath.FromSlash(namespace))
+)
+
+const (
+	namespaceEnvVar = "DMS3GX_GO_NAMESPACE"
+	vendorEnvVar    = "DMS3GX_GO_VENDOR"
+)
+
+// loadConfig sets up the layout settings for the package we are run in, if
+// any.
+func loadConfig() {
+	root, err := dms3gx.GetPackageRoot()
+	if err == nil {
+		pkg, err := LoadPackageFile(filepath.Join(root, dms3gx.PkgFileName))
+		if err != nil {
+			VLog("not loading config from package file: %s", err)
+		} else {
+			setLayout(pkg.Dms3Gx.Namespace, pkg.Dms3Gx.VendorDir)
+		}
+	}
+
+	setLayout(os.Getenv(namespaceEnvVar), os.Getenv(vendorEnvVar))
+}
+
+// setLayout overrides the namespace and vendor root with the given values,
+// ignoring empty ones.
+func setLayout(ns, vendor string) {
+	if ns = strings.Trim(ns, "/"); ns != "" {
+		namespace = ns
+	}
+	if vendor != "" {
+		vendorRoot = filepath.Clean(vendor)
+	}
+	vendorDir = filepath.Join(vendorRoot, filepath.FromSlash(namespace))
+}
+
+// dms3gxImport returns the import path of the dms3gx package with the given
+// hash and name.
+func dms3gxImport(hash, name string) string {
+	return path.Join(namespace, hash, name)
+}
+
+// isDms3gxImport reports whether imp points into a dms3gx package.
+func isDms3gxImport(imp string) bool {
+	return strings.HasPrefix(imp, namespace+"/")
+}
+
+// dms3gxPackageImport trims imp, which must point into a dms3gx package, down
+// to the import path of the package's root, '<namespace>/<hash>/<name>'. It
+// returns false if imp is too short to name a package.
+func dms3gxPackageImport(imp string) (string, bool) {
+	parts := strings.Split(imp, "/")
+	n := strings.Count(namespace, "/") + 3
+	if len(parts) < n {
+		return "", false
+	}
+	return strings.Join(parts[:n], "/"), true
+}
+
+// isVendored reports whether the path rel, relative to a package root, lies
+// within its vendor root.
+func isVendored(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	vr := filepath.ToSlash(vendorRoot)
+	return rel == vr || strings.HasPrefix(rel, vr+"/")
+}
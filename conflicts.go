@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	cli "github.com/codegangsta/cli"
+)
+
+var ConflictsCommand = cli.Command{
+	Name:  "conflicts",
+	Usage: "report dependencies included at more than one hash",
+	Description: `finds every dvcs import path provided by more than one package in the
+dependency tree, and lists the versions of each along with the packages
+depending on them. Exits with an error if any are found, so that it can be
+used in CI.
+
+Two copies of the same package compiled into one binary have distinct
+types, which causes confusing type mismatch errors.`,
+	Action: func(c *cli.Context) error {
+		g, err := loadRootDepGraph()
+		if err != nil {
+			return err
+		}
+
+		conflicts := g.conflicts()
+		if len(conflicts) == 0 {
+			fmt.Println("no conflicts found")
+			return nil
+		}
+
+		for i, cf := range conflicts {
+			if i > 0 {
+				fmt.Println()
+			}
+			g.writeConflict(os.Stdout, cf)
+		}
+
+		return fmt.Errorf("found %d conflicting dependencies", len(conflicts))
+	},
+}
+
+// depConflict is a dvcs import path provided by several packages
+type depConflict struct {
+	Import string
+	Nodes  []*depNode
+}
+
+// conflicts returns every dvcs import path reachable at more than one hash,
+// ordered by import path.
+func (g *depGraph) conflicts() []depConflict {
+	byImport := make(map[string][]*depNode)
+	for _, n := range g.sortedNodes() {
+		if n.DvcsImport != "" {
+			byImport[n.DvcsImport] = append(byImport[n.DvcsImport], n)
+		}
+	}
+
+	var out []depConflict
+	for imp, nodes := range byImport {
+		if len(nodes) > 1 {
+			out = append(out, depConflict{Import: imp, Nodes: nodes})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Import < out[j].Import
+	})
+	return out
+}
+
+func (g *depGraph) writeConflict(w io.Writer, cf depConflict) {
+	fmt.Fprintf(w, "%s is included at %d hashes:\n", cf.Import, len(cf.Nodes))
+	for _, n := range cf.Nodes {
+		var deps []string
+		for _, d := range g.dependents(n.Hash) {
+			deps = append(deps, d.String())
+		}
+		fmt.Fprintf(w, "  %s %s %s\n", n.Hash, n.Name, n.Version)
+		fmt.Fprintf(w, "    required by: %s\n", strings.Join(deps, ", "))
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cli "github.com/codegangsta/cli"
+	rw "github.com/dms3-why/dms3gx-go/rewrite"
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+	. "github.com/whyrusleeping/stump"
+)
+
+// records the decisions made by dedupe, in the package root
+const dedupeLockFile = "dms3gx-go.lock"
+
+var DedupeCommand = cli.Command{
+	Name:  "dedupe",
+	Usage: "rewrite vendored dependencies to use a single hash of each package",
+	Description: `picks one hash for every dvcs import path included at several hashes,
+and rewrites the imports and package.json dependencies of the root package
+and of every dependency installed under the vendor directory to use it. The
+decisions are recorded in ` + dedupeLockFile + `, and later runs stick to
+them as long as the policy is the same and no pin overrides them.
+
+Policies:
+  root    use the hash the root package depends on, falling back to the
+          newest version for packages it does not depend on directly
+  newest  use the newest version
+
+A hash can be forced for a package with '--pin <dvcsimport>=<hash>'.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "policy",
+			Value: "root",
+			Usage: "how to pick the hash to keep: root or newest",
+		},
+		cli.StringSliceFlag{
+			Name:  "pin",
+			Value: &cli.StringSlice{},
+			Usage: "use the given hash for a package, as <dvcsimport>=<hash>",
+		},
+		diffFlag,
+	},
+	Action: func(c *cli.Context) error {
+		policy := c.String("policy")
+		if policy != "root" && policy != "newest" {
+			return fmt.Errorf("unknown policy %q", policy)
+		}
+
+		pins := make(map[string]string)
+		for _, p := range c.StringSlice("pin") {
+			parts := strings.SplitN(p, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid pin %q, expected <dvcsimport>=<hash>", p)
+			}
+			pins[parts[0]] = parts[1]
+		}
+
+		g, err := loadRootDepGraph()
+		if err != nil {
+			return err
+		}
+
+		lockfile := filepath.Join(g.Root.Dir, dedupeLockFile)
+		var prev dedupeLock
+		if err := loadMap(&prev, lockfile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("reading %s: %s", lockfile, err)
+		}
+
+		lock := &dedupeLock{
+			Policy:   policy,
+			Packages: make(map[string]*dedupeDecision),
+		}
+		mapping := make(map[string]string)
+		replaced := make(map[string]*depNode)
+		for _, cf := range g.conflicts() {
+			pin := pins[cf.Import]
+			if dec, ok := prev.Packages[cf.Import]; ok && pin == "" && prev.Policy == policy && cf.has(dec.Hash) {
+				VLog("  - keeping %s for %s as recorded in %s", dec.Hash, cf.Import, dedupeLockFile)
+				pin = dec.Hash
+			}
+
+			keep, err := g.pickDedupe(cf, policy, pin)
+			if err != nil {
+				return err
+			}
+
+			dec := &dedupeDecision{Hash: keep.Hash, Version: keep.Version}
+			for _, n := range cf.Nodes {
+				if n != keep {
+					mapping[dms3gxImport(n.Hash, n.Name)] = dms3gxImport(keep.Hash, keep.Name)
+					replaced[n.Hash] = keep
+					dec.Replaces = append(dec.Replaces, n.Hash)
+				}
+			}
+			lock.Packages[cf.Import] = dec
+
+			Log("using %s %s for %s, replacing %s", keep.Hash, keep.Version, cf.Import, strings.Join(dec.Replaces, ", "))
+		}
+
+		if len(mapping) == 0 {
+			Log("no duplicate dependencies found")
+			return nil
+		}
+
+		if c.Bool("diff") {
+			return g.diffDedupe(mapping, replaced)
+		}
+
+		if err := g.applyDedupe(mapping, replaced); err != nil {
+			return err
+		}
+
+		return lock.save(lockfile)
+	},
+}
+
+type dedupeDecision struct {
+	Hash     string   `json:"hash"`
+	Version  string   `json:"version"`
+	Replaces []string `json:"replaces"`
+}
+
+type dedupeLock struct {
+	Policy string `json:"policy"`
+
+	// by dvcs import path
+	Packages map[string]*dedupeDecision `json:"packages"`
+}
+
+func (l *dedupeLock) save(file string) error {
+	out, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(out, '\n'), 0644)
+}
+
+// pickDedupe chooses the package to keep out of a conflict.
+func (g *depGraph) pickDedupe(cf depConflict, policy, pin string) (*depNode, error) {
+	if pin != "" {
+		for _, n := range cf.Nodes {
+			if n.Hash == pin {
+				return n, nil
+			}
+		}
+		return nil, fmt.Errorf("%s is pinned to %s, which is not in the dependency tree", cf.Import, pin)
+	}
+
+	if policy == "root" {
+		for _, h := range g.Root.Deps {
+			for _, n := range cf.Nodes {
+				if n.Hash == h {
+					return n, nil
+				}
+			}
+		}
+	}
+
+	nodes := append([]*depNode(nil), cf.Nodes...)
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return newerVersion(nodes[i].Version, nodes[j].Version)
+	})
+	return nodes[0], nil
+}
+
+// newerVersion reports whether version a is newer than b.
+func newerVersion(a, b string) bool {
+	older, err := versionComp(b, a)
+	if err != nil {
+		return a > b
+	}
+	return older
+}
+
+func (cf depConflict) has(hash string) bool {
+	for _, n := range cf.Nodes {
+		if n.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupedNodes returns the packages dedupe modifies: the root package and
+// every dependency installed under its vendor directory.
+func (g *depGraph) dedupedNodes() []*depNode {
+	vendored := filepath.Join(g.Root.Dir, vendorDir) + string(filepath.Separator)
+
+	out := []*depNode{g.Root}
+	for _, n := range g.sortedNodes() {
+		if !strings.HasPrefix(n.Dir, vendored) {
+			VLog("  - skipping %s (%s), not installed locally", n.Name, n.Hash)
+			continue
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// applyDedupe rewrites the imports of the root package and of every vendored
+// dependency according to mapping, and points their dependencies on the
+// replaced hashes at the packages replacing them. The imports of every
+// package are staged before any is rewritten, so that a package failing to
+// rewrite leaves all of them untouched.
+func (g *depGraph) applyDedupe(mapping map[string]string, replaced map[string]*depNode) error {
+	rwf := rewriteMapper(mapping)
+	nodes := g.dedupedNodes()
+
+	var staged []*rw.Staged
+	for _, n := range nodes {
+		VLog("  - rewriting imports of %s", n)
+		s, res, err := rw.StageImports(n.Dir, rwf, goFileFilter, rw.Options{})
+		if err != nil {
+			for _, s := range staged {
+				s.Abort()
+			}
+			return fmt.Errorf("rewriting %s, no package was changed: %s", n, err)
+		}
+		VLog("  - staged %d of %d files", res.Changed, res.Scanned)
+		staged = append(staged, s)
+	}
+
+	for i, s := range staged {
+		if err := s.Commit(); err != nil {
+			for _, s := range staged[i+1:] {
+				s.Abort()
+			}
+			return fmt.Errorf("rewriting %s: %s", nodes[i], err)
+		}
+	}
+
+	for _, n := range nodes {
+		if !dedupeDeps(n.Pkg, replaced) {
+			continue
+		}
+
+		VLog("  - updating dependencies of %s", n)
+		err := dms3gx.SavePackageFile(n.Pkg, filepath.Join(n.Dir, dms3gx.PkgFileName))
+		if err != nil {
+			return fmt.Errorf("updating package file of %s: %s", n, err)
+		}
+	}
+	return nil
+}
+
+// diffDedupe prints the changes applyDedupe would make.
+func (g *depGraph) diffDedupe(mapping map[string]string, replaced map[string]*depNode) error {
+	rwf := rewriteMapper(mapping)
+	for _, n := range g.dedupedNodes() {
+		if err := runRewrite(n.Dir, rwf, goFileFilter, rewriteOptions{Diff: true}); err != nil {
+			return fmt.Errorf("rewriting %s: %s", n, err)
+		}
+
+		for _, dep := range n.Pkg.Dependencies {
+			if keep, ok := replaced[dep.Hash]; ok {
+				Log("%s: dependency %s %s would be replaced by %s", n, dep.Name, dep.Hash, keep.Hash)
+			}
+		}
+	}
+	return nil
+}
+
+// dedupeDeps points the dependencies of pkg on replaced hashes at the
+// packages replacing them, dropping those it then depends on twice. It
+// reports whether anything changed.
+func dedupeDeps(pkg *Package, replaced map[string]*depNode) bool {
+	var changed bool
+	var deps []*dms3gx.Dependency
+	seen := make(map[string]bool)
+	for _, dep := range pkg.Dependencies {
+		if keep, ok := replaced[dep.Hash]; ok {
+			dep = &dms3gx.Dependency{
+				Name:    keep.Name,
+				Hash:    keep.Hash,
+				Version: keep.Version,
+			}
+			changed = true
+		}
+
+		if seen[dep.Hash] {
+			continue
+		}
+		seen[dep.Hash] = true
+		deps = append(deps, dep)
+	}
+
+	pkg.Dependencies = deps
+	return changed
+}
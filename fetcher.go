@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	. "github.com/whyrusleeping/stump"
+)
+
+// Fetcher puts the sources of the package with dvcs import path imppath
+// under '<gopath>/src/<imppath>'.
+type Fetcher interface {
+	Fetch(imppath, gopath string) error
+}
+
+// parseFetcher returns the fetcher described by spec, as given to
+// 'import --source':
+//
+//	goget          run 'go get'
+//	gopath[=dir]   use checkouts already in GOPATH dir, or userGopath
+//	mirror=dir     clone from the git mirrors in dir
+func parseFetcher(spec, userGopath string) (Fetcher, error) {
+	kind, arg := spec, ""
+	if i := strings.Index(spec, "="); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+
+	switch kind {
+	case "goget":
+		return goGetFetcher{}, nil
+	case "gopath":
+		if arg == "" {
+			arg = userGopath
+		}
+		return gopathFetcher{src: arg}, nil
+	case "mirror":
+		if arg == "" {
+			return nil, fmt.Errorf("mirror source needs a directory, as mirror=<dir>")
+		}
+		return mirrorFetcher{dir: arg}, nil
+	default:
+		return nil, fmt.Errorf("unknown source %q", spec)
+	}
+}
+
+// goGetFetcher fetches packages with 'go get'.
+type goGetFetcher struct{}
+
+func (goGetFetcher) Fetch(imppath, gopath string) error {
+	cmd := exec.Command("go", "get", imppath)
+	env := os.Environ()
+	for i, e := range env {
+		if strings.HasPrefix(e, "GOPATH=") {
+			env[i] = "GOPATH=" + gopath
+		}
+	}
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("go get failed: %s - %s", string(out), err)
+	}
+	return nil
+}
+
+// gopathFetcher takes packages from existing checkouts in the GOPATH src,
+// copying them if that is not the GOPATH being imported into.
+type gopathFetcher struct {
+	src string
+}
+
+func (f gopathFetcher) Fetch(imppath, gopath string) error {
+	from := filepath.Join(f.src, "src", filepath.FromSlash(imppath))
+	if _, err := os.Stat(from); err != nil {
+		return fmt.Errorf("%s is not checked out in %s: %s", imppath, f.src, err)
+	}
+
+	if filepath.Clean(f.src) == filepath.Clean(gopath) {
+		return nil
+	}
+
+	VLog("  - copying %s from %s", imppath, from)
+	return copyTree(from, filepath.Join(gopath, "src", filepath.FromSlash(imppath)))
+}
+
+// mirrorFetcher clones packages from a directory of git mirrors laid out by
+// import path, either as '<dir>/<imppath>.git' or '<dir>/<imppath>'.
+type mirrorFetcher struct {
+	dir string
+}
+
+func (f mirrorFetcher) Fetch(imppath, gopath string) error {
+	dst := filepath.Join(gopath, "src", filepath.FromSlash(imppath))
+	if _, err := os.Stat(dst); err == nil {
+		VLog("  - %s already checked out", imppath)
+		return nil
+	}
+
+	base := filepath.Join(f.dir, filepath.FromSlash(imppath))
+	for _, repo := range []string{base + ".git", base} {
+		if _, err := os.Stat(repo); err != nil {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+
+		VLog("  - cloning %s from %s", imppath, repo)
+		out, err := exec.Command("git", "clone", "--quiet", repo, dst).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("git clone failed: %s - %s", string(out), err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("no mirror of %s in %s", imppath, f.dir)
+}
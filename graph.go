@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	cli "github.com/codegangsta/cli"
+	rw "github.com/dms3-why/dms3gx-go/rewrite"
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+	. "github.com/whyrusleeping/stump"
+)
+
+var GraphCommand = cli.Command{
+	Name:  "graph",
+	Usage: "print the full dependency graph of the current package",
+	Description: `walks the dependencies of the current package, transitive ones
+included, and prints every package along with the edges between them.
+
+Formats:
+  tree  an indented tree, packages already shown are marked (*)
+  dot   a graphviz digraph, render it with 'dot -Tsvg'
+  json  an object with the root package, all dependencies and all edges.
+        Edges from the root package have an empty "from" hash.`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Value: "tree",
+			Usage: "output format: tree, dot or json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		g, err := loadRootDepGraph()
+		if err != nil {
+			return err
+		}
+
+		switch c.String("format") {
+		case "tree":
+			g.WriteTree(os.Stdout)
+		case "dot":
+			g.WriteDot(os.Stdout)
+		case "json":
+			return g.WriteJSON(os.Stdout)
+		default:
+			return fmt.Errorf("unknown format %q", c.String("format"))
+		}
+		return nil
+	},
+}
+
+// depNode is a package in a dependency graph. The root package has an
+// empty hash.
+type depNode struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Hash       string `json:"hash"`
+	DvcsImport string `json:"dvcsimport,omitempty"`
+
+	Pkg *Package `json:"-"`
+
+	// Dir is the directory of the package, '<hash dir>/<name>' for
+	// dependencies
+	Dir string `json:"-"`
+
+	// Deps lists the hashes of the direct dependencies, in package file
+	// order
+	Deps []string `json:"-"`
+}
+
+func (n *depNode) String() string {
+	if n.Hash == "" {
+		return fmt.Sprintf("%s %s", n.Name, n.Version)
+	}
+	return fmt.Sprintf("%s %s %s", n.Name, n.Version, n.Hash)
+}
+
+type depEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// depGraph holds a package and all of its dependencies.
+type depGraph struct {
+	Root  *depNode
+	Nodes map[string]*depNode
+
+	// imports of each package by hash, filled in by importsOf
+	imports map[string][]rw.Import
+}
+
+// loadRootDepGraph loads the dependency graph of the package we are run in.
+func loadRootDepGraph() (*depGraph, error) {
+	root, err := dms3gx.GetPackageRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	pkg, err := LoadPackageFile(filepath.Join(root, dms3gx.PkgFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	return loadDepGraph(pkg, root, filepath.Join(root, vendorDir))
+}
+
+// loadDepGraph walks the dependencies of pkg, located in dir, the same way
+// buildRewriteMapping does.
+func loadDepGraph(pkg *Package, dir, pkgdir string) (*depGraph, error) {
+	g := &depGraph{
+		Root: &depNode{
+			Name:       pkg.Name,
+			Version:    pkg.Version,
+			DvcsImport: pkg.Dms3Gx.DvcsImport,
+			Pkg:        pkg,
+			Dir:        dir,
+		},
+		Nodes:   make(map[string]*depNode),
+		imports: make(map[string][]rw.Import),
+	}
+
+	var process func(n *depNode) error
+	process = func(n *depNode) error {
+		for _, dep := range n.Pkg.Dependencies {
+			n.Deps = append(n.Deps, dep.Hash)
+			if _, ok := g.Nodes[dep.Hash]; ok {
+				continue
+			}
+
+			cpkg, pdir, err := findDep(dep, pkgdir)
+			if err != nil {
+				VLog("error loading dep %q of %q: %s", dep.Name, n.Name, err)
+				return fmt.Errorf("package %q not found. (dependency of %s)", dep.Name, n.Name)
+			}
+
+			child := &depNode{
+				Name:       cpkg.Name,
+				Version:    cpkg.Version,
+				Hash:       dep.Hash,
+				DvcsImport: cpkg.Dms3Gx.DvcsImport,
+				Pkg:        cpkg,
+				Dir:        filepath.Join(pdir, cpkg.Name),
+			}
+			g.Nodes[dep.Hash] = child
+
+			// recurse!
+			if err := process(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := process(g.Root); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// node returns the node with the given hash, the root for an empty one.
+func (g *depGraph) node(hash string) *depNode {
+	if hash == "" {
+		return g.Root
+	}
+	return g.Nodes[hash]
+}
+
+// importsOf returns the imports of the go files of n, scanning them on first
+// use. Files that fail to parse are skipped.
+func (g *depGraph) importsOf(n *depNode) []rw.Import {
+	if imps, ok := g.imports[n.Hash]; ok {
+		return imps
+	}
+
+	imps, _, err := rw.ListImports(n.Dir, goFileFilter)
+	if err != nil {
+		VLog("scanning imports of %s: %s", n.Name, err)
+	}
+	g.imports[n.Hash] = imps
+	return imps
+}
+
+// sortedNodes returns all dependencies ordered by name, then hash.
+func (g *depGraph) sortedNodes() []*depNode {
+	var out []*depNode
+	for _, n := range g.Nodes {
+		out = append(out, n)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Name != out[j].Name {
+			return out[i].Name < out[j].Name
+		}
+		return out[i].Hash < out[j].Hash
+	})
+	return out
+}
+
+// Edges returns every edge of the graph, ordered by parent.
+func (g *depGraph) Edges() []depEdge {
+	var edges []depEdge
+	for _, n := range append([]*depNode{g.Root}, g.sortedNodes()...) {
+		for _, h := range n.Deps {
+			edges = append(edges, depEdge{From: n.Hash, To: h})
+		}
+	}
+	return edges
+}
+
+// dependents returns the packages directly depending on the one with the
+// given hash.
+func (g *depGraph) dependents(hash string) []*depNode {
+	var out []*depNode
+	for _, n := range append([]*depNode{g.Root}, g.sortedNodes()...) {
+		for _, h := range n.Deps {
+			if h == hash {
+				out = append(out, n)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (g *depGraph) WriteTree(w io.Writer) {
+	seen := make(map[string]bool)
+
+	var write func(n *depNode, depth int)
+	write = func(n *depNode, depth int) {
+		indent := strings.Repeat("  ", depth)
+		if seen[n.Hash] {
+			fmt.Fprintf(w, "%s%s (*)\n", indent, n)
+			return
+		}
+		seen[n.Hash] = true
+
+		fmt.Fprintf(w, "%s%s\n", indent, n)
+		for _, h := range n.Deps {
+			write(g.Nodes[h], depth+1)
+		}
+	}
+	write(g.Root, 0)
+}
+
+func (g *depGraph) WriteDot(w io.Writer) {
+	id := func(n *depNode) string {
+		if n.Hash == "" {
+			return dotQuote("root")
+		}
+		return dotQuote(n.Hash)
+	}
+
+	fmt.Fprintln(w, "digraph dependencies {")
+	fmt.Fprintf(w, "\t%s [label=%s, shape=box];\n", id(g.Root), dotQuote(g.Root.Name+"\n"+g.Root.Version))
+	for _, n := range g.sortedNodes() {
+		label := n.Name + " " + n.Version + "\n" + n.Hash
+		if n.DvcsImport != "" {
+			label += "\n" + n.DvcsImport
+		}
+		fmt.Fprintf(w, "\t%s [label=%s];\n", id(n), dotQuote(label))
+	}
+	for _, e := range g.Edges() {
+		fmt.Fprintf(w, "\t%s -> %s;\n", id(g.node(e.From)), id(g.node(e.To)))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func (g *depGraph) WriteJSON(w io.Writer) error {
+	out, err := json.MarshalIndent(struct {
+		Root  *depNode   `json:"root"`
+		Nodes []*depNode `json:"nodes"`
+		Edges []depEdge  `json:"edges"`
+	}{g.Root, g.sortedNodes(), g.Edges()}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
+
+// dotQuote quotes s for use as a graphviz ID.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
@@ -6,34 +6,25 @@ import (
 	"go/scanner"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 
 	rw "github.com/dms3-why/dms3gx-go/rewrite"
 	dms3gx "github.com/dms3-why/dms3gx/gxutil"
 	. "github.com/whyrusleeping/stump"
 )
 
-func doUpdate(dir, oldimp, newimp string) error {
-	rwf := func(in string) string {
-		if in == oldimp {
-			return newimp
-		}
-
-		if strings.HasPrefix(in, oldimp+"/") {
-			return strings.Replace(in, oldimp, newimp, 1)
-		}
-
-		return in
-	}
+func doUpdate(dir, oldimp, newimp string, opts rewriteOptions) error {
+	rwf := rewriteMapper(map[string]string{oldimp: newimp})
 
 	filter := func(in string) bool {
-		return strings.HasSuffix(in, ".go") && !strings.HasPrefix(in, "vendor")
+		return strings.HasSuffix(in, ".go") && !isVendored(in)
 	}
 
-	return rw.RewriteImports(dir, rwf, filter)
+	return runRewrite(dir, rwf, filter, opts)
 }
 
 func pathIsNotStdlib(path string) bool {
@@ -45,26 +36,53 @@ func pathIsNotStdlib(path string) bool {
 	return false
 }
 
+// isSubImport reports whether imp is base or one of its subpackages.
+func isSubImport(imp, base string) bool {
+	return imp == base || strings.HasPrefix(imp, base+"/")
+}
+
 type Importer struct {
-	pkgs    map[string]*dms3gx.Dependency
+	// packages published so far by dvcs import path, guarded by pkgsLock
+	pkgs     map[string]*dms3gx.Dependency
+	pkgsLock sync.Mutex
+
 	gopath  string
-	pm      *dms3gx.PM
+	pm      PackageManager
 	rewrite bool
 	yesall  bool
 	preMap  map[string]string
 
+	// modules taken from the module cache instead of being fetched,
+	// see UseGoModules
+	modules  map[string]*goModule
+	modpaths *rw.PrefixMap
+
+	// fetcher puts the sources of packages under gopath, 'go get' by
+	// default
+	fetcher Fetcher
+
+	// stateFile records the packages published so far importing
+	// stateArgs, see UseStateFile
+	stateFile string
+	stateArgs importArgs
+
 	bctx build.Context
 }
 
-func NewImporter(rw bool, gopath string, premap map[string]string) (*Importer, error) {
-	cfg, err := dms3gx.LoadConfig()
-	if err != nil {
-		return nil, err
-	}
+// NewImporter creates an importer publishing packages through pm, or
+// through the dms3gx daemon if pm is nil.
+func NewImporter(rewrite bool, gopath string, premap map[string]string, pm PackageManager) (*Importer, error) {
+	if pm == nil {
+		cfg, err := dms3gx.LoadConfig()
+		if err != nil {
+			return nil, err
+		}
 
-	pm, err := dms3gx.NewPM(cfg)
-	if err != nil {
-		return nil, err
+		dpm, err := dms3gx.NewPM(cfg)
+		if err != nil {
+			return nil, err
+		}
+		pm = &daemonPM{pm: dpm}
 	}
 
 	if premap == nil {
@@ -75,12 +93,15 @@ func NewImporter(rw bool, gopath string, premap map[string]string) (*Importer, e
 	bctx.GOPATH = gopath
 
 	return &Importer{
-		pkgs:    make(map[string]*dms3gx.Dependency),
-		gopath:  gopath,
-		pm:      pm,
-		rewrite: rw,
-		preMap:  premap,
-		bctx:    bctx,
+		pkgs:     make(map[string]*dms3gx.Dependency),
+		gopath:   gopath,
+		pm:       pm,
+		rewrite:  rewrite,
+		preMap:   premap,
+		modules:  make(map[string]*goModule),
+		modpaths: new(rw.PrefixMap),
+		fetcher:  goGetFetcher{},
+		bctx:     bctx,
 	}, nil
 }
 
@@ -102,36 +123,68 @@ func getBaseDVCS(path string) string {
 }
 
 func (i *Importer) Dms3GxPublishGoPackage(imppath string) (*dms3gx.Dependency, error) {
-	imppath = getBaseDVCS(imppath)
-	if d, ok := i.pkgs[imppath]; ok {
+	imppath = i.baseImport(imppath)
+	if d, ok := i.published(imppath); ok {
 		return d, nil
 	}
 
 	if hash, ok := i.preMap[imppath]; ok {
-		pkg, err := i.pm.GetPackageTo(hash, filepath.Join(vendorDir, hash))
+		return i.getMapped(imppath, hash)
+	}
+
+	pkgpath := path.Join(i.gopath, "src", imppath)
+
+	// make sure its local
+	mod, err := i.fetch(imppath, pkgpath)
+	if err != nil {
+		return nil, err
+	}
+
+	pkg, err := i.loadOrInitPackage(imppath, pkgpath, mod)
+	if err != nil {
+		return nil, err
+	}
+
+	// recurse!
+	depsToVendor, err := i.DepsToVendorForPackage(imppath)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching deps for %s: %s", imppath, err)
+	}
+
+	for n, child := range depsToVendor {
+		Log("- processing dep %s for %s [%d / %d]", child, imppath, n+1, len(depsToVendor))
+		if isSubImport(child, imppath) {
+			continue
+		}
+		childdep, err := i.Dms3GxPublishGoPackage(child)
 		if err != nil {
 			return nil, err
 		}
 
-		dep := &dms3gx.Dependency{
-			Hash:    hash,
-			Name:    pkg.Name,
-			Version: pkg.Version,
-		}
-		i.pkgs[imppath] = dep
-		return dep, nil
+		pkg.Dependencies = append(pkg.Dependencies, childdep)
 	}
 
-	// make sure its local
-	err := i.GoGet(imppath)
+	return i.publish(imppath, pkgpath, pkg)
+}
+
+// getMapped installs the package the --map document gives for imppath.
+func (i *Importer) getMapped(imppath, hash string) (*dms3gx.Dependency, error) {
+	pkg, err := i.pm.GetPackageTo(hash, filepath.Join(vendorDir, hash))
 	if err != nil {
-		if !strings.Contains(err.Error(), "no buildable Go source files") {
-			Error("go get %s failed: %s", imppath, err)
-			return nil, err
-		}
+		return nil, err
 	}
 
-	pkgpath := path.Join(i.gopath, "src", imppath)
+	dep := &dms3gx.Dependency{
+		Hash:    hash,
+		Name:    pkg.Name,
+		Version: pkg.Version,
+	}
+	return dep, i.addPublished(imppath, dep)
+}
+
+// loadOrInitPackage loads the package file of the package at pkgpath,
+// creating it if needed, with its dependencies wiped out.
+func (i *Importer) loadOrInitPackage(imppath, pkgpath string, mod *goModule) (*Package, error) {
 	pkgFilePath := path.Join(pkgpath, dms3gx.PkgFileName)
 	pkg, err := LoadPackageFile(pkgFilePath)
 	if err != nil {
@@ -163,29 +216,22 @@ func (i *Importer) Dms3GxPublishGoPackage(imppath string) (*dms3gx.Dependency, e
 		}
 	}
 
-	// wipe out existing dependencies
-	pkg.Dependencies = nil
-
-	// recurse!
-	depsToVendor, err := i.DepsToVendorForPackage(imppath)
-	if err != nil {
-		return nil, fmt.Errorf("error fetching deps for %s: %s", imppath, err)
+	if mod != nil {
+		pkg.Version = gxVersion(mod.Version)
+		pkg.Dms3Gx.DvcsImport = mod.Path
 	}
 
-	for n, child := range depsToVendor {
-		Log("- processing dep %s for %s [%d / %d]", child, imppath, n+1, len(depsToVendor))
-		if strings.HasPrefix(child, imppath) {
-			continue
-		}
-		childdep, err := i.Dms3GxPublishGoPackage(child)
-		if err != nil {
-			return nil, err
-		}
+	// wipe out existing dependencies
+	pkg.Dependencies = nil
 
-		pkg.Dependencies = append(pkg.Dependencies, childdep)
-	}
+	return pkg, nil
+}
 
-	err = dms3gx.SavePackageFile(pkg, pkgFilePath)
+// publish rewrites the imports of the package at pkgpath to the packages
+// published so far and publishes it. Its dependencies must be published
+// already.
+func (i *Importer) publish(imppath, pkgpath string, pkg *Package) (*dms3gx.Dependency, error) {
+	err := dms3gx.SavePackageFile(pkg, path.Join(pkgpath, dms3gx.PkgFileName))
 	if err != nil {
 		return nil, err
 	}
@@ -217,8 +263,54 @@ func (i *Importer) Dms3GxPublishGoPackage(imppath string) (*dms3gx.Dependency, e
 		Name:    pkg.Name,
 		Version: pkg.Version,
 	}
+	return dep, i.addPublished(imppath, dep)
+}
+
+// published returns the package imppath was published as, if it was.
+func (i *Importer) published(imppath string) (*dms3gx.Dependency, bool) {
+	i.pkgsLock.Lock()
+	defer i.pkgsLock.Unlock()
+	d, ok := i.pkgs[imppath]
+	return d, ok
+}
+
+// addPublished records that imppath was published as dep.
+func (i *Importer) addPublished(imppath string, dep *dms3gx.Dependency) error {
+	i.pkgsLock.Lock()
+	defer i.pkgsLock.Unlock()
+
 	i.pkgs[imppath] = dep
-	return dep, nil
+	if err := i.saveState(); err != nil {
+		return fmt.Errorf("saving import state: %s", err)
+	}
+	return nil
+}
+
+// fetch puts the sources of imppath at pkgpath, copying them from the
+// module cache if they belong to a module loaded by UseGoModules. It returns
+// that module, if any.
+func (i *Importer) fetch(imppath, pkgpath string) (*goModule, error) {
+	if mod, ok := i.modules[imppath]; ok {
+		if err := mod.check(); err != nil {
+			return nil, err
+		}
+
+		VLog("  - copying %s@%s from %s", mod.Path, mod.Version, mod.Dir)
+		err := copyModule(mod, pkgpath)
+		if err != nil {
+			return nil, fmt.Errorf("copying %s@%s: %s", mod.Path, mod.Version, err)
+		}
+		return mod, nil
+	}
+
+	err := i.fetcher.Fetch(imppath, i.gopath)
+	if err != nil {
+		if !strings.Contains(err.Error(), "no buildable Go source files") {
+			Error("fetching %s failed: %s", imppath, err)
+			return nil, err
+		}
+	}
+	return nil, nil
 }
 
 func (i *Importer) DepsToVendorForPackage(path string) ([]string, error) {
@@ -242,14 +334,14 @@ func (i *Importer) DepsToVendorForPackage(path string) ([]string, error) {
 	} else {
 		imps := append(gopkg.Imports, gopkg.TestImports...)
 		// if the package existed and has go code in it
-		gdeps := getBaseDVCS(path) + "/Godeps/_workspace/src/"
+		gdeps := i.baseImport(path) + "/Godeps/_workspace/src/"
 		for _, child := range imps {
 			if strings.HasPrefix(child, gdeps) {
 				child = child[len(gdeps):]
 			}
 
-			child = getBaseDVCS(child)
-			if pathIsNotStdlib(child) && !strings.HasPrefix(child, path) {
+			child = i.baseImport(child)
+			if pathIsNotStdlib(child) && !isSubImport(child, path) {
 				rdeps[child] = struct{}{}
 			}
 		}
@@ -279,6 +371,7 @@ func (i *Importer) DepsToVendorForPackage(path string) ([]string, error) {
 	for d, _ := range rdeps {
 		depsToVendor = append(depsToVendor, d)
 	}
+	sort.Strings(depsToVendor)
 
 	return depsToVendor, nil
 }
@@ -295,12 +388,20 @@ func skipDir(name string) bool {
 func (i *Importer) rewriteImports(pkgpath string) error {
 
 	filter := func(p string) bool {
-		return !strings.HasPrefix(p, "vendor") &&
+		return !isVendored(p) &&
 			!strings.HasPrefix(p, ".git") &&
 			strings.HasSuffix(p, ".go") &&
 			!strings.HasPrefix(p, "Godeps")
 	}
 
+	mapping := make(map[string]string)
+	i.pkgsLock.Lock()
+	for imp, dep := range i.pkgs {
+		mapping[imp] = dms3gxImport(dep.Hash, dep.Name)
+	}
+	i.pkgsLock.Unlock()
+	pkgmap := rw.NewPrefixMap(mapping)
+
 	base := pkgpath[len(i.gopath)+5:]
 	gdepath := base + "/Godeps/_workspace/src/"
 	rwf := func(in string) string {
@@ -313,43 +414,10 @@ func (i *Importer) rewriteImports(pkgpath string) error {
 			return in
 		}
 
-		dep, ok := i.pkgs[in]
-		if ok {
-			return "dms3gx/" + dep.Hash + "/" + dep.Name
-		}
-
-		parts := strings.Split(in, "/")
-		if len(parts) > 3 {
-			obase := strings.Join(parts[:3], "/")
-			dep, bok := i.pkgs[obase]
-			if !bok {
-				return in
-			}
-
-			return strings.Replace(in, obase, "dms3gx/"+dep.Hash+"/"+dep.Name, 1)
-		}
-
-		return in
+		return pkgmap.Rewrite(in)
 	}
 
-	return rw.RewriteImports(pkgpath, rwf, filter)
-}
-
-// TODO: take an option to grab packages from local GOPATH
-func (imp *Importer) GoGet(path string) error {
-	cmd := exec.Command("go", "get", path)
-	env := os.Environ()
-	for i, e := range env {
-		if strings.HasPrefix(e, "GOPATH=") {
-			env[i] = "GOPATH=" + imp.gopath
-		}
-	}
-	cmd.Env = env
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("go get failed: %s - %s", string(out), err)
-	}
-	return nil
+	return runRewrite(pkgpath, rwf, filter, rewriteOptions{})
 }
 
 func writeDms3GxIgnore(dir string, ignore []string) error {
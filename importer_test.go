@@ -0,0 +1,355 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+)
+
+// recordingPM is a localPM recording the names of the packages it
+// publishes, in order.
+type recordingPM struct {
+	*localPM
+
+	lk        sync.Mutex
+	published []string
+}
+
+func (pm *recordingPM) PublishPackage(dir string, pkg *dms3gx.PackageBase) (string, error) {
+	hash, err := pm.localPM.PublishPackage(dir, pkg)
+	if err != nil {
+		return "", err
+	}
+
+	pm.lk.Lock()
+	defer pm.lk.Unlock()
+	pm.published = append(pm.published, pkg.Name)
+	return hash, nil
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, src := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// chdirTemp moves the test into a fresh directory, as packages taken from
+// the --map document are installed under the working directory.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return dir
+}
+
+// gopathMode makes go/build look packages up in the GOPATH, the way the
+// importer expects, for the rest of the test.
+func gopathMode(t *testing.T) {
+	t.Helper()
+	old, ok := os.LookupEnv("GO111MODULE")
+	if err := os.Setenv("GO111MODULE", "off"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv("GO111MODULE", old)
+		} else {
+			os.Unsetenv("GO111MODULE")
+		}
+	})
+}
+
+// importFixture is a GOPATH in which app imports c and lib/sub, which both
+// import lib2, and app imports mapped, which is only in the store.
+var importFixture = map[string]string{
+	"src/github.com/x/app/app.go": `package app
+
+import (
+	"github.com/x/c"
+	"github.com/x/lib/sub"
+	"github.com/x/mapped"
+)
+
+var _ = c.C + sub.S + mapped.M
+`,
+	"src/github.com/x/c/c.go": `package c
+
+import "github.com/x/lib2"
+
+const C = lib2.L
+`,
+	"src/github.com/x/lib/sub/sub.go": `package sub
+
+import "github.com/x/lib2"
+
+const S = lib2.L
+`,
+	"src/github.com/x/lib2/lib2.go": `package lib2
+
+const L = 1
+`,
+}
+
+// newTestImporter sets up an importer of importFixture publishing to a
+// localPM, with mapped published to the store beforehand and given in the
+// map document.
+func newTestImporter(t *testing.T) (*Importer, *recordingPM) {
+	t.Helper()
+	gopathMode(t)
+	gopath := t.TempDir()
+	writeFiles(t, gopath, importFixture)
+
+	lpm, err := newLocalPM(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapped := t.TempDir()
+	writeFiles(t, mapped, map[string]string{"mapped.go": "package mapped\n\nconst M = 1\n"})
+	if err := lpm.InitPkg(mapped, "mapped", "go", nil); err != nil {
+		t.Fatal(err)
+	}
+	mhash, err := lpm.PublishPackage(mapped, &dms3gx.PackageBase{Name: "mapped"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pm := &recordingPM{localPM: lpm}
+	premap := map[string]string{"github.com/x/mapped": mhash}
+	importer, err := NewImporter(true, gopath, premap, pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importer.yesall = true
+	importer.fetcher = gopathFetcher{src: gopath}
+	return importer, pm
+}
+
+// storedPackage loads the package file of dep from the store of pm.
+func storedPackage(t *testing.T, pm *recordingPM, dep *dms3gx.Dependency) *Package {
+	t.Helper()
+	pkg, err := LoadPackageFile(filepath.Join(pm.dir, dep.Hash, dep.Name, dms3gx.PkgFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkg
+}
+
+// checkImported checks that the packages of importFixture were published
+// after their dependencies, depending on and importing what they were
+// published as.
+func checkImported(t *testing.T, importer *Importer, pm *recordingPM) {
+	t.Helper()
+	deps := map[string][]string{
+		"app":  {"github.com/x/c", "github.com/x/lib", "github.com/x/mapped"},
+		"c":    {"github.com/x/lib2"},
+		"lib":  {"github.com/x/lib2"},
+		"lib2": nil,
+	}
+
+	order := make(map[string]int)
+	for n, name := range pm.published {
+		if _, ok := order[name]; ok {
+			t.Errorf("%s was published twice", name)
+		}
+		order[name] = n
+	}
+	if len(order) != len(deps) {
+		t.Fatalf("published %v, expected each of app, c, lib and lib2 once", pm.published)
+	}
+
+	for name, imps := range deps {
+		dep, ok := importer.published("github.com/x/" + name)
+		if !ok {
+			t.Fatalf("%s was not recorded as published", name)
+		}
+		pkg := storedPackage(t, pm, dep)
+
+		want := make(map[string]bool)
+		for _, imp := range imps {
+			d, ok := importer.published(imp)
+			if !ok {
+				t.Fatalf("%s was not recorded as published", imp)
+			}
+			want[d.Hash] = true
+
+			if n, ok := order[d.Name]; ok && n > order[name] {
+				t.Errorf("%s was published before its dependency %s", name, d.Name)
+			}
+		}
+
+		if len(pkg.Dependencies) != len(want) {
+			t.Errorf("%s depends on %d packages, expected %d", name, len(pkg.Dependencies), len(want))
+		}
+		for _, d := range pkg.Dependencies {
+			if !want[d.Hash] {
+				t.Errorf("%s depends on unexpected %s %s", name, d.Name, d.Hash)
+			}
+		}
+	}
+
+	app, _ := importer.published("github.com/x/app")
+	src, err := ioutil.ReadFile(filepath.Join(pm.dir, app.Hash, "app", "app.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, imp := range deps["app"] {
+		d, _ := importer.published(imp)
+		if !strings.Contains(string(src), `"`+dms3gxImport(d.Hash, d.Name)) {
+			t.Errorf("app.go does not import %s as %s:\n%s", imp, dms3gxImport(d.Hash, d.Name), src)
+		}
+	}
+}
+
+func TestImportPublishesDepsFirst(t *testing.T) {
+	chdirTemp(t)
+	importer, pm := newTestImporter(t)
+
+	dep, err := importer.Dms3GxPublishGoPackage("github.com/x/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dep.Name != "app" {
+		t.Errorf("published app as %s", dep.Name)
+	}
+
+	checkImported(t, importer, pm)
+}
+
+func TestImportPreMap(t *testing.T) {
+	wd := chdirTemp(t)
+	importer, pm := newTestImporter(t)
+
+	if _, err := importer.Dms3GxPublishGoPackage("github.com/x/app"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range pm.published {
+		if name == "mapped" {
+			t.Error("mapped was published again instead of taken from the map")
+		}
+	}
+
+	mhash := importer.preMap["github.com/x/mapped"]
+	dep, ok := importer.published("github.com/x/mapped")
+	if !ok || dep.Hash != mhash || dep.Name != "mapped" {
+		t.Fatalf("mapped was recorded as %v, expected %s", dep, mhash)
+	}
+
+	installed := filepath.Join(wd, vendorDir, mhash, "mapped", "mapped.go")
+	if _, err := os.Stat(installed); err != nil {
+		t.Errorf("mapped was not installed from the store: %s", err)
+	}
+}
+
+func TestImportStateRecordsHashes(t *testing.T) {
+	wd := chdirTemp(t)
+	importer, pm := newTestImporter(t)
+
+	state := filepath.Join(wd, "state.json")
+	args := importArgs{Package: "github.com/x/app"}
+	if err := importer.UseStateFile(state, false, args); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := importer.Dms3GxPublishGoPackage("github.com/x/app"); err != nil {
+		t.Fatal(err)
+	}
+
+	var st importState
+	if err := loadMap(&st, state); err != nil {
+		t.Fatal(err)
+	}
+	var mapping map[string]string
+	if err := loadMap(&mapping, importStateMap(state)); err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Args != args {
+		t.Errorf("state records an import of %q, expected %q", st.Args, args)
+	}
+	if len(st.Packages) != 5 {
+		t.Errorf("state records %d packages, expected 5", len(st.Packages))
+	}
+	for imp, dep := range st.Packages {
+		if _, err := os.Stat(filepath.Join(pm.dir, dep.Hash, dep.Name)); err != nil {
+			t.Errorf("%s is recorded as %s, which is not in the store", imp, dep.Hash)
+		}
+		if mapping[imp] != dep.Hash {
+			t.Errorf("map records %s as %q, state as %q", imp, mapping[imp], dep.Hash)
+		}
+	}
+
+	// resuming something else is refused
+	other, _ := newTestImporter(t)
+	for _, a := range []importArgs{
+		{Package: "github.com/x/c"},
+		{Package: "github.com/x/app", GoMod: wd},
+	} {
+		if err := other.UseStateFile(state, true, a); err == nil {
+			t.Errorf("resuming an import of %q from one of %q succeeded", a, args)
+		}
+	}
+
+	// resuming takes everything as published
+	resumed, pm2 := newTestImporter(t)
+	if err := resumed.UseStateFile(state, true, args); err != nil {
+		t.Fatal(err)
+	}
+	dep, err := resumed.Dms3GxPublishGoPackage("github.com/x/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dep.Hash != st.Packages["github.com/x/app"].Hash {
+		t.Errorf("resumed import published app as %s, expected %s", dep.Hash, st.Packages["github.com/x/app"].Hash)
+	}
+	if len(pm2.published) != 0 {
+		t.Errorf("resumed import published %v again", pm2.published)
+	}
+
+	if err := resumed.RemoveStateFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(state); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed: %v", state, err)
+	}
+
+	// the map is kept, for a later import to take everything from
+	var later map[string]string
+	if err := loadMap(&later, importStateMap(state)); err != nil {
+		t.Fatalf("loading the map after the import: %s", err)
+	}
+	mapped, _ := newTestImporter(t)
+	pm3 := &recordingPM{localPM: pm.localPM}
+	mapped.pm = pm3
+	mapped.preMap = later
+	dep, err = mapped.Dms3GxPublishGoPackage("github.com/x/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dep.Hash != st.Packages["github.com/x/app"].Hash {
+		t.Errorf("mapped import got app as %s, expected %s", dep.Hash, st.Packages["github.com/x/app"].Hash)
+	}
+	if len(pm3.published) != 0 {
+		t.Errorf("mapped import published %v again", pm3.published)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+	. "github.com/whyrusleeping/stump"
+)
+
+// default state file of 'import', in the working directory
+const defaultImportState = "dms3gx-go-import.json"
+
+// importArgs is what an import was asked to import
+type importArgs struct {
+	// package given on the command line, if any
+	Package string `json:"package,omitempty"`
+
+	// absolute path of the --gomod directory, if any
+	GoMod string `json:"gomod,omitempty"`
+}
+
+func (a importArgs) String() string {
+	switch {
+	case a.GoMod == "":
+		return a.Package
+	case a.Package == "":
+		return "--gomod " + a.GoMod
+	default:
+		return a.Package + " --gomod " + a.GoMod
+	}
+}
+
+// importState is the progress of an import, saved after every package
+type importState struct {
+	Args importArgs `json:"args"`
+
+	// published packages by dvcs import path
+	Packages map[string]*dms3gx.Dependency `json:"packages"`
+}
+
+// importStateMap returns the file the progress saved in state is also
+// written to, in the format 'import --map' reads.
+func importStateMap(state string) string {
+	return strings.TrimSuffix(state, ".json") + ".map.json"
+}
+
+// UseStateFile makes the importer save the progress of importing args to
+// file after every package. If resume is set, the packages already recorded
+// in file are taken as published, provided file records an import of the
+// same args.
+func (i *Importer) UseStateFile(file string, resume bool, args importArgs) error {
+	i.stateFile = file
+	i.stateArgs = args
+
+	if !resume {
+		if _, err := os.Stat(file); err == nil {
+			Log("overwriting progress of an earlier import in %s, use --resume to continue it", file)
+		}
+		return nil
+	}
+
+	var st importState
+	if err := loadMap(&st, file); err != nil {
+		return fmt.Errorf("loading import state: %s", err)
+	}
+
+	if st.Args != args {
+		return fmt.Errorf("%s records an import of %q, not %q, so it cannot be resumed", file, st.Args, args)
+	}
+
+	for imp, dep := range st.Packages {
+		i.pkgs[imp] = dep
+	}
+	Log("resuming import, %d packages already published", len(st.Packages))
+	return nil
+}
+
+// RemoveStateFile removes the state file once there is no import left to
+// resume. Its map counterpart is kept for later imports to pass to --map.
+func (i *Importer) RemoveStateFile() error {
+	if i.stateFile == "" {
+		return nil
+	}
+
+	if err := os.Remove(i.stateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	Log("published packages are listed in %s, for use with --map", importStateMap(i.stateFile))
+	return nil
+}
+
+// saveState writes the packages published so far to the state file and its
+// map counterpart. pkgsLock must be held.
+func (i *Importer) saveState() error {
+	if i.stateFile == "" {
+		return nil
+	}
+
+	st := importState{Args: i.stateArgs, Packages: i.pkgs}
+	mapping := make(map[string]string)
+	for imp, dep := range i.pkgs {
+		mapping[imp] = dep.Hash
+	}
+
+	if err := writeJSONFile(i.stateFile, st); err != nil {
+		return err
+	}
+	return writeJSONFile(importStateMap(i.stateFile), mapping)
+}
+
+// writeJSONFile replaces file with the json encoding of v, atomically.
+func writeJSONFile(file string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(file+".temp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".temp", file)
+}
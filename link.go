@@ -114,7 +114,7 @@ func listLinkedPackages() ([][]string, error) {
 	if err != nil {
 		return links, err
 	}
-	dms3gxbase := filepath.Join(srcdir, "dms3gx", "dms3fs")
+	dms3gxbase := filepath.Join(srcdir, filepath.FromSlash(namespace))
 
 	filepath.Walk(dms3gxbase, func(path string, fi os.FileInfo, err error) error {
 		relpath, err := filepath.Rel(dms3gxbase, path)
@@ -143,15 +143,15 @@ func listLinkedPackages() ([][]string, error) {
 
 // dms3gx get $hash
 // go get $dvcsimport
-// rm -rf $GOPATH/src/dms3gx/dms3fs/$hash/$pkgname
-// ln -s $GOPATH/src/$dvcsimport $GOPATH/src/dms3gx/dms3fs/$hash/$pkgname
+// rm -rf $GOPATH/src/$namespace/$hash/$pkgname
+// ln -s $GOPATH/src/$dvcsimport $GOPATH/src/$namespace/$hash/$pkgname
 // cd $GOPATH/src/$dvcsimport && dms3gx install && dms3gx-go rewrite
 func linkPackage(hash string) (string, error) {
 	srcdir, err := dms3gx.InstallPath("go", "", true)
 	if err != nil {
 		return "", err
 	}
-	dms3gxdir := filepath.Join(srcdir, "dms3gx", "dms3fs", hash)
+	dms3gxdir := filepath.Join(srcdir, filepath.FromSlash(namespace), hash)
 
 	dms3gxget := exec.Command("dms3gx", "get", hash, "-o", dms3gxdir)
 	dms3gxget.Stdout = os.Stderr
@@ -211,14 +211,14 @@ func linkPackage(hash string) (string, error) {
 	return target, nil
 }
 
-// rm -rf $GOPATH/src/dms3gx/dms3fs/$hash
+// rm -rf $GOPATH/src/$namespace/$hash
 // dms3gx get $hash
 func unlinkPackage(hash string) (string, error) {
 	srcdir, err := dms3gx.InstallPath("go", "", true)
 	if err != nil {
 		return "", err
 	}
-	dms3gxdir := filepath.Join(srcdir, "dms3gx", "dms3fs", hash)
+	dms3gxdir := filepath.Join(srcdir, filepath.FromSlash(namespace), hash)
 
 	err = os.RemoveAll(dms3gxdir)
 	if err != nil {
@@ -22,8 +22,6 @@ import (
 	. "github.com/whyrusleeping/stump"
 )
 
-var vendorDir = filepath.Join("vendor", "dms3gx", "dms3fs")
-
 var cwd string
 
 // for go packages, extra info
@@ -33,6 +31,12 @@ type GoInfo struct {
 	// GoVersion sets a compiler version requirement, users will be warned if installing
 	// a package using an unsupported compiler
 	GoVersion string `json:"goversion,omitempty"`
+
+	// Namespace and VendorDir override the import path prefix of dms3gx
+	// packages and the directory local dependencies are installed in when
+	// set in the root package.
+	Namespace string `json:"namespace,omitempty"`
+	VendorDir string `json:"vendordir,omitempty"`
 }
 
 type Package struct {
@@ -70,6 +74,7 @@ func main() {
 	}
 	app.Before = func(c *cli.Context) error {
 		Verbose = c.Bool("verbose")
+		loadConfig()
 		return nil
 	}
 
@@ -93,6 +98,17 @@ func main() {
 		UpdateCommand,
 		DvcsDepsCommand,
 		LinkCommand,
+		BuildCommand,
+		TestCommand,
+		ModInitCommand,
+		ProxyCommand,
+		GraphCommand,
+		WhyCommand,
+		ConflictsCommand,
+		DedupeCommand,
+		CheckCommand,
+		UnusedCommand,
+		StatusCommand,
 
 		DevCopyCommand,
 		// Go tool compat:
@@ -142,6 +158,8 @@ var HookCommand = cli.Command{
 		preTestHookCommand,
 		postTestHookCommand,
 		testHookCommand,
+		checkHookCommand,
+		prePublishHookCommand,
 	},
 	Action: func(c *cli.Context) error { return nil },
 }
@@ -169,6 +187,37 @@ for each.`,
 			Name:  "map",
 			Usage: "json document mapping imports to prexisting hashes",
 		},
+		cli.StringFlag{
+			Name:  "gomod",
+			Usage: "directory of a go.mod whose requirements are taken from the module cache",
+		},
+		cli.StringFlag{
+			Name:  "source",
+			Value: "goget",
+			Usage: "where to fetch packages from: goget, gopath[=<dir>] or mirror=<dir>",
+		},
+		cli.StringFlag{
+			Name:  "local",
+			Usage: "publish to a content addressed store in the given directory instead of the dms3gx daemon",
+		},
+		cli.BoolFlag{
+			Name:  "plan",
+			Usage: "print the packages that would be published, in order, without publishing; their sources are still fetched into the GOPATH, use --tmpdir to leave it untouched",
+		},
+		cli.StringFlag{
+			Name:  "state",
+			Value: defaultImportState,
+			Usage: "file progress is saved to after every package, also written in the '--map' format to <state>.map.json for later imports; the former is removed once the import succeeds",
+		},
+		cli.BoolFlag{
+			Name:  "resume",
+			Usage: "continue the import recorded in the state file, which must be of the same package and --gomod",
+		},
+		cli.IntFlag{
+			Name:  "jobs",
+			Value: 1,
+			Usage: "number of packages to rewrite and publish at once, to the daemon or the --local store; all packages are fetched first, one at a time",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		var mapping map[string]string
@@ -180,6 +229,14 @@ for each.`,
 			}
 		}
 
+		// before --tmpdir replaces it
+		userGopath, _ := getGoPath()
+
+		fetcher, err := parseFetcher(c.String("source"), userGopath)
+		if err != nil {
+			return err
+		}
+
 		var gopath string
 		if c.Bool("tmpdir") {
 			dir, err := ioutil.TempDir("", "dms3gx-go-import")
@@ -200,35 +257,105 @@ for each.`,
 			}
 
 			gopath = gp
+
+			if c.Bool("plan") {
+				Log("planning fetches sources into %s, use --tmpdir to leave it untouched", gopath)
+			}
 		}
 
-		importer, err := NewImporter(c.Bool("rewrite"), gopath, mapping)
+		var pm PackageManager
+		if store := c.String("local"); store != "" {
+			lpm, err := newLocalPM(store)
+			if err != nil {
+				return err
+			}
+			pm = lpm
+		}
+
+		importer, err := NewImporter(c.Bool("rewrite"), gopath, mapping, pm)
 		if err != nil {
 			return err
 		}
 
 		importer.yesall = c.Bool("yesall")
+		importer.fetcher = fetcher
 
-		if !c.Args().Present() {
+		args := importArgs{Package: c.Args().First()}
+
+		// without a package, import everything the go.mod requires
+		var imppaths []string
+		if moddir := c.String("gomod"); moddir != "" {
+			direct, err := importer.UseGoModules(moddir)
+			if err != nil {
+				return fmt.Errorf("loading go modules: %s", err)
+			}
+
+			args.GoMod, err = filepath.Abs(moddir)
+			if err != nil {
+				return err
+			}
+			if args.Package == "" {
+				imppaths = direct
+			}
+		}
+
+		if args.Package != "" {
+			imppaths = []string{args.Package}
+		} else if args.GoMod == "" {
 			return fmt.Errorf("must specify a package name")
 		}
 
-		pkg := c.Args().First()
-		Log("vendoring package %s", pkg)
+		// planning publishes nothing, but shows what a resumed import
+		// has left to do
+		if c.Bool("resume") || !c.Bool("plan") {
+			err := importer.UseStateFile(c.String("state"), c.Bool("resume"), args)
+			if err != nil {
+				return err
+			}
+		}
 
-		_, err = importer.Dms3GxPublishGoPackage(pkg)
+		if c.Bool("plan") {
+			return planImport(importer, imppaths)
+		}
+
+		if c.Int("jobs") > 1 {
+			err = importConcurrently(importer, imppaths, c.Int("jobs"))
+		} else {
+			err = importSerially(importer, imppaths, args.Package == "")
+		}
 		if err != nil {
 			return err
 		}
 
-		return nil
+		return importer.RemoveStateFile()
 	},
 }
 
+// importSerially publishes imppaths one after the other, each after its
+// dependencies. modules is set when they are the requirements of a go.mod.
+func importSerially(importer *Importer, imppaths []string, modules bool) error {
+	for n, imp := range imppaths {
+		if modules {
+			Log("vendoring module %s [%d / %d]", imp, n+1, len(imppaths))
+		} else {
+			Log("vendoring package %s", imp)
+		}
+
+		if _, err := importer.Dms3GxPublishGoPackage(imp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var UpdateCommand = cli.Command{
 	Name:      "update",
 	Usage:     "update a packages imports to a new path",
 	ArgsUsage: "[old import] [new import]",
+	Flags: []cli.Flag{
+		diffFlag,
+		sortFlag,
+	},
 	Action: func(c *cli.Context) error {
 		if len(c.Args()) < 2 {
 			return fmt.Errorf("must specify current and new import names")
@@ -237,7 +364,7 @@ var UpdateCommand = cli.Command{
 		oldimp := c.Args()[0]
 		newimp := c.Args()[1]
 
-		err := doUpdate(cwd, oldimp, newimp)
+		err := doUpdate(cwd, oldimp, newimp, rewriteFlags(c))
 		if err != nil {
 			return err
 		}
@@ -248,15 +375,19 @@ var UpdateCommand = cli.Command{
 
 var rewriteUndoAlias = cli.Command{
 	Name: "uw",
+	Flags: []cli.Flag{
+		diffFlag,
+		sortFlag,
+	},
 	Action: func(c *cli.Context) error {
-		return fullRewrite(true)
+		return fullRewrite(true, rewriteFlags(c))
 	},
 }
 
 var RewriteCommand = cli.Command{
 	Name:      "rewrite",
 	Usage:     "temporary hack to evade causality",
-	ArgsUsage: "[optional package name]",
+	ArgsUsage: "[optional package name, or directory with '--recover']",
 	Aliases:   []string{"rw"},
 	Flags: []cli.Flag{
 		cli.BoolFlag{
@@ -275,15 +406,35 @@ var RewriteCommand = cli.Command{
 			Name:  "fix",
 			Usage: "more error tolerant version of '--undo'",
 		},
+		diffFlag,
+		sortFlag,
+		cli.BoolFlag{
+			Name:  "recover",
+			Usage: "finish a rewrite that was interrupted, of the directory given as argument or of the package root",
+		},
+		cli.BoolFlag{
+			Name:  "rollback",
+			Usage: "with '--recover', restore the files changed by the interrupted rewrite instead",
+		},
 	},
 	Action: func(c *cli.Context) error {
+		// interrupted rewrites of dependencies are recovered by
+		// directory
+		if c.Bool("recover") && c.Args().Present() {
+			return recoverRewrite(c.Args().First(), c.Bool("rollback"))
+		}
+
 		root, err := dms3gx.GetPackageRoot()
 		if err != nil {
 			return err
 		}
 
+		if c.Bool("recover") {
+			return recoverRewrite(root, c.Bool("rollback"))
+		}
+
 		if c.Bool("fix") {
-			return fixImports(root)
+			return fixImports(root, rewriteFlags(c))
 		}
 
 		pkg, err := LoadPackageFile(filepath.Join(root, dms3gx.PkgFileName))
@@ -325,7 +476,7 @@ var RewriteCommand = cli.Command{
 			return nil
 		}
 
-		err = doRewrite(pkg, root, mapping)
+		err = doRewrite(pkg, root, mapping, rewriteFlags(c))
 		if err != nil {
 			return err
 		}
@@ -334,11 +485,28 @@ var RewriteCommand = cli.Command{
 	},
 }
 
+func recoverRewrite(root string, rollback bool) error {
+	n, err := rw.Recover(root, rollback)
+	if err != nil {
+		return fmt.Errorf("recovering rewrite failed: %s", err)
+	}
+
+	switch {
+	case n == 0:
+		Log("no interrupted rewrite to recover")
+	case rollback:
+		Log("restored %d files", n)
+	default:
+		Log("finished rewriting %d files", n)
+	}
+	return nil
+}
+
 var DvcsDepsCommand = cli.Command{
 	Name:  "dvcs-deps",
 	Usage: "display all dvcs deps",
 	Action: func(c *cli.Context) error {
-		i, err := NewImporter(false, os.Getenv("GOPATH"), nil)
+		i, err := NewImporter(false, os.Getenv("GOPATH"), nil, nil)
 		if err != nil {
 			return err
 		}
@@ -392,20 +560,18 @@ func goGetPackage(path string) error {
 	return nil
 }
 
-func fixImports(path string) error {
-	fixmap := make(map[string]string)
+func fixImports(path string, opts rewriteOptions) error {
+	fixmap := new(rw.PrefixMap)
 	gopath := os.Getenv("GOPATH")
 	rwf := func(imp string) string {
-		if strings.HasPrefix(imp, "dms3gx/dms3fs/") {
-			parts := strings.Split(imp, "/")
-			canon := strings.Join(parts[:4], "/")
-			rest := strings.Join(parts[4:], "/")
-			if rest != "" {
-				rest = "/" + rest
+		if isDms3gxImport(imp) {
+			if _, _, ok := fixmap.Match(imp); ok {
+				return fixmap.Rewrite(imp)
 			}
 
-			if base, ok := fixmap[canon]; ok {
-				return base + rest
+			canon, ok := dms3gxPackageImport(imp)
+			if !ok {
+				return imp
 			}
 
 			var pkg Package
@@ -415,8 +581,8 @@ func fixImports(path string) error {
 				return imp
 			}
 			if pkg.Dms3Gx.DvcsImport != "" {
-				fixmap[imp] = pkg.Dms3Gx.DvcsImport
-				return pkg.Dms3Gx.DvcsImport + rest
+				fixmap.Add(canon, pkg.Dms3Gx.DvcsImport)
+				return fixmap.Rewrite(imp)
 			}
 			fmt.Printf("Package %s has no dvcs import set!\n", imp)
 		}
@@ -426,7 +592,10 @@ func fixImports(path string) error {
 	filter := func(s string) bool {
 		return strings.HasSuffix(s, ".go")
 	}
-	return rw.RewriteImports(path, rwf, filter)
+
+	// leave files that do not parse as they are instead of giving up
+	opts.SkipErrors = true
+	return runRewrite(path, rwf, filter, opts)
 }
 
 var GetCommand = cli.Command{
@@ -465,7 +634,7 @@ var GetCommand = cli.Command{
 			return err
 		}
 
-		if err := doRewrite(&pkg, pkgdir, rwmapping); err != nil {
+		if err := doRewrite(&pkg, pkgdir, rwmapping, rewriteOptions{}); err != nil {
 			return err
 		}
 
@@ -601,7 +770,7 @@ var postInstallHookCommand = cli.Command{
 		// update sub-package refs here
 		// ex:
 		// if this package is 'github.com/X/Y' replace all imports
-		// matching 'github.com/X/Y*' with 'dms3gx/<hash>/name*'
+		// matching 'github.com/X/Y*' with '<namespace>/<hash>/name*'
 
 		var pkg Package
 		err := dms3gx.FindPackageInDir(&pkg, npkg)
@@ -614,9 +783,9 @@ var postInstallHookCommand = cli.Command{
 		// build rewrite mapping from parent package if
 		// this call is made on one in the vendor directory
 		var reldir string
-		if strings.Contains(npkg, "vendor/dms3gx/dms3fs") {
-			reldir = strings.Split(npkg, "vendor/dms3gx/dms3fs")[0]
-			reldir = filepath.Join(reldir, "vendor", "dms3gx", "dms3fs")
+		if strings.Contains(npkg, vendorDir) {
+			reldir = strings.Split(npkg, vendorDir)[0]
+			reldir = filepath.Join(reldir, vendorDir)
 		} else {
 			reldir = dir
 		}
@@ -628,10 +797,10 @@ var postInstallHookCommand = cli.Command{
 		}
 
 		hash := filepath.Base(npkg)
-		newimp := "dms3gx/dms3fs/" + hash + "/" + pkg.Name
+		newimp := dms3gxImport(hash, pkg.Name)
 		mapping[pkg.Dms3Gx.DvcsImport] = newimp
 
-		err = doRewrite(&pkg, dir, mapping)
+		err = doRewrite(&pkg, dir, mapping, rewriteOptions{})
 		if err != nil {
 			return fmt.Errorf("rewrite failed: %s", err)
 		}
@@ -640,31 +809,20 @@ var postInstallHookCommand = cli.Command{
 	},
 }
 
-func doRewrite(pkg *Package, cwd string, mapping map[string]string) error {
-	rwm := func(in string) string {
-		m, ok := mapping[in]
-		if ok {
-			return m
-		}
-
-		for k, v := range mapping {
-			if strings.HasPrefix(in, k+"/") {
-				nmapping := strings.Replace(in, k, v, 1)
-				mapping[in] = nmapping
-				return nmapping
-			}
-		}
-
-		mapping[in] = in
-		return in
-	}
+// rewriteMapper returns a function rewriting imports according to mapping,
+// where each entry also applies to the subpackages of its key. The longest
+// matching entry is used.
+func rewriteMapper(mapping map[string]string) func(string) string {
+	return rw.NewPrefixMap(mapping).Rewrite
+}
 
-	filter := func(s string) bool {
-		return strings.HasSuffix(s, ".go")
-	}
+func goFileFilter(s string) bool {
+	return strings.HasSuffix(s, ".go") && !isVendored(s)
+}
 
+func doRewrite(pkg *Package, cwd string, mapping map[string]string, opts rewriteOptions) error {
 	VLog("  - rewriting imports")
-	err := rw.RewriteImports(cwd, rwm, filter)
+	err := runRewrite(cwd, rewriteMapper(mapping), goFileFilter, opts)
 	if err != nil {
 		return err
 	}
@@ -673,6 +831,65 @@ func doRewrite(pkg *Package, cwd string, mapping map[string]string) error {
 	return nil
 }
 
+// rewriteOptions are the settings shared by the commands rewriting imports
+type rewriteOptions struct {
+	// Diff prints a unified diff of the changes instead of making them
+	Diff bool
+
+	rw.Options
+}
+
+// flags of the commands rewriting imports, read by rewriteFlags
+var (
+	diffFlag = cli.BoolFlag{
+		Name:  "diff",
+		Usage: "print a diff of the changes without touching files",
+	}
+	sortFlag = cli.BoolFlag{
+		Name:  "sort",
+		Usage: "sort rewritten import declarations like gofmt instead of only replacing paths",
+	}
+)
+
+// rewriteFlags returns the rewrite options set by diffFlag and sortFlag.
+func rewriteFlags(c *cli.Context) rewriteOptions {
+	return rewriteOptions{
+		Diff:    c.Bool("diff"),
+		Options: rw.Options{Sort: c.Bool("sort")},
+	}
+}
+
+// runRewrite rewrites the imports under dir and logs a summary of the
+// result. Any per-file failures are returned as a single error. If
+// opts.Diff is set, no files are touched and a unified diff of the changes
+// is printed instead.
+func runRewrite(dir string, rwf func(string) string, filter func(string) bool, opts rewriteOptions) error {
+	if opts.Diff {
+		res, err := rw.DiffImports(dir, rwf, filter, opts.Options, os.Stdout)
+		if res != nil {
+			VLog("  - %d of %d files would be rewritten", res.Changed, res.Scanned)
+			logSkipped(res)
+		}
+		return err
+	}
+
+	res, err := rw.RewriteImports(dir, rwf, filter, opts.Options)
+	if res != nil {
+		VLog("  - rewrote imports in %d of %d files", res.Changed, res.Scanned)
+		if len(res.Errors) > 0 {
+			Log("rewrote imports in %d of %d files, %d failed", res.Changed, res.Scanned, len(res.Errors))
+		}
+		logSkipped(res)
+	}
+	return err
+}
+
+func logSkipped(res *rw.Result) {
+	for _, ferr := range res.Skipped {
+		Log("skipped %s", ferr)
+	}
+}
+
 var installLocHookCommand = cli.Command{
 	Name:  "install-path",
 	Usage: "prints out install path",
@@ -696,7 +913,7 @@ var installLocHookCommand = cli.Command{
 				return fmt.Errorf("install-path cwd: %s", err)
 			}
 
-			fmt.Println(filepath.Join(cwd, "vendor"))
+			fmt.Println(filepath.Join(cwd, vendorRoot))
 			return nil
 		}
 	},
@@ -705,13 +922,16 @@ var installLocHookCommand = cli.Command{
 var postUpdateHookCommand = cli.Command{
 	Name:  "post-update",
 	Usage: "rewrite go package imports to new versions",
+	Flags: []cli.Flag{
+		diffFlag,
+	},
 	Action: func(c *cli.Context) error {
 		if len(c.Args()) < 2 {
 			Fatal("must specify two arguments")
 		}
-		before := "dms3gx/dms3fs/" + c.Args()[0]
-		after := "dms3gx/dms3fs/" + c.Args()[1]
-		err := doUpdate(cwd, before, after)
+		before := path.Join(namespace, c.Args()[0])
+		after := path.Join(namespace, c.Args()[1])
+		err := doUpdate(cwd, before, after, rewriteFlags(c))
 		if err != nil {
 			return err
 		}
@@ -722,8 +942,13 @@ var postUpdateHookCommand = cli.Command{
 
 var testHookCommand = cli.Command{
 	Name:            "test",
+	Usage:           "run 'go test', set " + overlayEnvVar + "=1 to build through an overlay instead of rewriting the tree",
 	SkipFlagParsing: true,
 	Action: func(c *cli.Context) error {
+		if useOverlay() {
+			return goWithOverlay("test", c.Args())
+		}
+
 		args := []string{"test"}
 		args = append(args, c.Args()...)
 		cmd := exec.Command("go", args...)
@@ -738,7 +963,11 @@ var preTestHookCommand = cli.Command{
 	Name:  "pre-test",
 	Usage: "",
 	Action: func(c *cli.Context) error {
-		return fullRewrite(false)
+		if useOverlay() {
+			// the test hook builds through an overlay
+			return nil
+		}
+		return fullRewrite(false, hookRewriteOptions)
 	},
 }
 
@@ -746,7 +975,10 @@ var postTestHookCommand = cli.Command{
 	Name:  "post-test",
 	Usage: "",
 	Action: func(c *cli.Context) error {
-		return fullRewrite(true)
+		if useOverlay() {
+			return nil
+		}
+		return fullRewrite(true, hookRewriteOptions)
 	},
 }
 
@@ -779,7 +1011,7 @@ var DevCopyCommand = cli.Command{
 			return err
 		}
 
-		return devCopySymlinking(filepath.Join(cwd, "vendor"), pkg, make(map[string]bool))
+		return devCopySymlinking(filepath.Join(cwd, vendorRoot), pkg, make(map[string]bool))
 	},
 }
 
@@ -800,7 +1032,7 @@ func devCopySymlinking(root string, pkg *Package, done map[string]bool) error {
 			return err
 		}
 
-		frompath := filepath.Join(root, "dms3gx", "dms3fs", dep.Hash, dep.Name)
+		frompath := filepath.Join(root, filepath.FromSlash(namespace), dep.Hash, dep.Name)
 		cmd := exec.Command("dms3gx-go", "rewrite", "--undo")
 		cmd.Stdout = os.Stdout
 		cmd.Stderr = os.Stderr
@@ -826,7 +1058,11 @@ func devCopySymlinking(root string, pkg *Package, done map[string]bool) error {
 	return nil
 }
 
-func fullRewrite(undo bool) error {
+// the test hooks leave files that do not parse alone, the go tool reports
+// them anyway
+var hookRewriteOptions = rewriteOptions{Options: rw.Options{SkipErrors: true}}
+
+func fullRewrite(undo bool, opts rewriteOptions) error {
 	root, err := dms3gx.GetPackageRoot()
 	if err != nil {
 		return err
@@ -845,7 +1081,7 @@ func fullRewrite(undo bool) error {
 		return fmt.Errorf("build of rewrite mapping failed:\n%s", err)
 	}
 
-	return doRewrite(pkg, root, mapping)
+	return doRewrite(pkg, root, mapping, opts)
 }
 
 func packagesGoImport(p string) (string, error) {
@@ -874,8 +1110,8 @@ func postImportHook(pkg *Package, npkgHash string) error {
 	if npkg.Dms3Gx.DvcsImport != "" {
 		q := fmt.Sprintf("update imports of %s to the newly imported package?", npkg.Dms3Gx.DvcsImport)
 		if yesNoPrompt(q, false) {
-			nimp := fmt.Sprintf("dms3gx/dms3fs/%s/%s", npkgHash, npkg.Name)
-			err := doUpdate(cwd, npkg.Dms3Gx.DvcsImport, nimp)
+			nimp := dms3gxImport(npkgHash, npkg.Name)
+			err := doUpdate(cwd, npkg.Dms3Gx.DvcsImport, nimp, rewriteOptions{})
 			if err != nil {
 				return err
 			}
@@ -984,25 +1220,32 @@ func versionComp(have, req string) (bool, error) {
 
 func globalPath() string {
 	gp, _ := getGoPath()
-	return filepath.Join(gp, "src", "dms3gx", "dms3fs")
+	return filepath.Join(gp, "src", filepath.FromSlash(namespace))
 }
 
 func loadDep(dep *dms3gx.Dependency, pkgdir string) (*Package, error) {
+	cpkg, _, err := findDep(dep, pkgdir)
+	return cpkg, err
+}
+
+// findDep is like loadDep, but also returns the directory the package was
+// found in, '<pkgdir>/<hash>' or its global counterpart.
+func findDep(dep *dms3gx.Dependency, pkgdir string) (*Package, string, error) {
 	var cpkg Package
 	pdir := filepath.Join(pkgdir, dep.Hash)
 	VLog("  - fetching dep: %s (%s)", dep.Name, dep.Hash)
 	err := dms3gx.FindPackageInDir(&cpkg, pdir)
 	if err != nil {
 		// try global
-		p := filepath.Join(globalPath(), dep.Hash)
-		VLog("  - checking in global namespace (%s)", p)
-		gerr := dms3gx.FindPackageInDir(&cpkg, p)
+		pdir = filepath.Join(globalPath(), dep.Hash)
+		VLog("  - checking in global namespace (%s)", pdir)
+		gerr := dms3gx.FindPackageInDir(&cpkg, pdir)
 		if gerr != nil {
-			return nil, fmt.Errorf("failed to find package: %s", gerr)
+			return nil, "", fmt.Errorf("failed to find package: %s", gerr)
 		}
 	}
 
-	return &cpkg, nil
+	return &cpkg, pdir, nil
 }
 
 // Rewrites the package `DvcsImport` with the dependency hash (or
@@ -1016,7 +1259,7 @@ func addRewriteForDep(dep *dms3gx.Dependency, pkg *Package, m map[string]string,
 	}
 
 	from := pkg.Dms3Gx.DvcsImport
-	to := "dms3gx/dms3fs/" + dep.Hash + "/" + pkg.Name
+	to := dms3gxImport(dep.Hash, pkg.Name)
 	if undo {
 		from, to = to, from
 	}
@@ -1080,6 +1323,7 @@ func buildMap(pkg *Package, m map[string]string) error {
 					Log("have two dep packages with same import path: ", ch.Dms3Gx.DvcsImport)
 					Log("  - ", e)
 					Log("  - ", dep.Hash)
+					Log("run 'dms3gx-go conflicts' for details")
 				}
 				continue
 			}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	. "github.com/whyrusleeping/stump"
+)
+
+// goModule is a module required by a go.mod, as resolved on disk
+type goModule struct {
+	Path    string
+	Version string
+
+	// Dir holds the sources of the module, either in the module cache or,
+	// for modules replaced by a directory, anywhere on disk
+	Dir string
+
+	// Indirect is set for requirements marked '// indirect'
+	Indirect bool
+
+	// cache is the module cache Dir is in, and src and srcVersion the
+	// module whose sources it holds, which only differs from Path and
+	// Version if replaced by another module. All three are unset for
+	// modules replaced by a directory.
+	cache, src, srcVersion string
+
+	// sum is the go.sum hash of the sources in the module cache
+	sum string
+}
+
+type modRequirement struct {
+	Path     string
+	Version  string
+	Indirect bool
+}
+
+type modReplacement struct {
+	// Version is empty if the replacement applies to every version
+	Old, OldVersion string
+
+	// NewVersion is empty if New is a directory
+	New, NewVersion string
+}
+
+// parseGoMod extracts the module path, requirements and replacements from
+// the contents of a go.mod.
+func parseGoMod(data []byte) (string, []modRequirement, []modReplacement, error) {
+	var modpath string
+	var reqs []modRequirement
+	var repls []modReplacement
+
+	var block string
+	for n, line := range strings.Split(string(data), "\n") {
+		var comment string
+		if i := strings.Index(line, "//"); i >= 0 {
+			comment = strings.TrimSpace(line[i+2:])
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if block != "" {
+			if fields[0] == ")" {
+				block = ""
+				continue
+			}
+			fields = append([]string{block}, fields...)
+		} else if len(fields) == 2 && fields[1] == "(" {
+			block = fields[0]
+			continue
+		}
+
+		for i, f := range fields {
+			if strings.HasPrefix(f, `"`) {
+				uf, err := strconv.Unquote(f)
+				if err != nil {
+					return "", nil, nil, fmt.Errorf("go.mod:%d: %s", n+1, err)
+				}
+				fields[i] = uf
+			}
+		}
+
+		switch fields[0] {
+		case "module":
+			if len(fields) != 2 {
+				return "", nil, nil, fmt.Errorf("go.mod:%d: malformed module directive", n+1)
+			}
+			modpath = fields[1]
+		case "require":
+			if len(fields) != 3 {
+				return "", nil, nil, fmt.Errorf("go.mod:%d: malformed require directive", n+1)
+			}
+			reqs = append(reqs, modRequirement{
+				Path:     fields[1],
+				Version:  fields[2],
+				Indirect: comment == "indirect" || strings.HasPrefix(comment, "indirect;"),
+			})
+		case "replace":
+			var r modReplacement
+			switch {
+			case len(fields) == 4 && fields[2] == "=>":
+				r.Old, r.New = fields[1], fields[3]
+			case len(fields) == 5 && fields[2] == "=>":
+				r.Old, r.New, r.NewVersion = fields[1], fields[3], fields[4]
+			case len(fields) == 5 && fields[3] == "=>":
+				r.Old, r.OldVersion, r.New = fields[1], fields[2], fields[4]
+			case len(fields) == 6 && fields[3] == "=>":
+				r.Old, r.OldVersion, r.New, r.NewVersion = fields[1], fields[2], fields[4], fields[5]
+			default:
+				return "", nil, nil, fmt.Errorf("go.mod:%d: malformed replace directive", n+1)
+			}
+			repls = append(repls, r)
+		}
+	}
+
+	if modpath == "" {
+		return "", nil, nil, fmt.Errorf("go.mod has no module directive")
+	}
+
+	return modpath, reqs, repls, nil
+}
+
+// readGoSum returns the module hashes listed in a go.sum, keyed by
+// 'path@version'. Hashes of go.mod files alone are skipped.
+func readGoSum(file string) (map[string]string, error) {
+	fi, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	sums := make(map[string]string)
+	scan := bufio.NewScanner(fi)
+	for scan.Scan() {
+		fields := strings.Fields(scan.Text())
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+		sums[fields[0]+"@"+fields[1]] = fields[2]
+	}
+
+	return sums, scan.Err()
+}
+
+// modCacheDir returns the root of the local module cache.
+func modCacheDir() (string, error) {
+	if dir := os.Getenv("GOMODCACHE"); dir != "" {
+		return dir, nil
+	}
+
+	out, err := exec.Command("go", "env", "GOMODCACHE").Output()
+	if err == nil {
+		if dir := strings.TrimSpace(string(out)); dir != "" {
+			return dir, nil
+		}
+	}
+
+	gp, err := getGoPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(gp, "pkg", "mod"), nil
+}
+
+// escapeModPath escapes a module path or version the way the module cache
+// does on disk, replacing every upper case letter with '!' followed by its
+// lower case form.
+func escapeModPath(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			b.WriteByte('!')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// loadGoModules resolves every module required by the go.mod in dir to its
+// sources in the module cache, honoring replace directives. The sources are
+// not looked at: go.mod also lists modules that were never downloaded as
+// none of their packages are needed, so they are only checked by
+// goModule.check once imported.
+func loadGoModules(dir string) ([]*goModule, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+
+	_, reqs, repls, err := parseGoMod(data)
+	if err != nil {
+		return nil, err
+	}
+
+	sums, err := readGoSum(filepath.Join(dir, "go.sum"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cache, err := modCacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("couldnt determine module cache: %s", err)
+	}
+
+	var mods []*goModule
+	for _, req := range reqs {
+		mod := &goModule{
+			Path:     req.Path,
+			Version:  req.Version,
+			Indirect: req.Indirect,
+		}
+
+		src, srcvers := req.Path, req.Version
+		if r := findReplacement(repls, req.Path, req.Version); r != nil {
+			if r.NewVersion == "" {
+				mod.Dir = r.New
+				if !filepath.IsAbs(mod.Dir) {
+					mod.Dir = filepath.Join(dir, mod.Dir)
+				}
+				mods = append(mods, mod)
+				continue
+			}
+			src, srcvers = r.New, r.NewVersion
+		}
+
+		mod.Dir = filepath.Join(cache, filepath.FromSlash(escapeModPath(src))+"@"+escapeModPath(srcvers))
+		mod.cache, mod.src, mod.srcVersion = cache, src, srcvers
+		mod.sum = sums[src+"@"+srcvers]
+		mods = append(mods, mod)
+	}
+
+	return mods, nil
+}
+
+func findReplacement(repls []modReplacement, path, version string) *modReplacement {
+	// a replacement for a specific version takes precedence
+	var found *modReplacement
+	for i, r := range repls {
+		if r.Old != path {
+			continue
+		}
+		if r.OldVersion == version {
+			return &repls[i]
+		}
+		if r.OldVersion == "" {
+			found = &repls[i]
+		}
+	}
+	return found
+}
+
+// check makes sure the sources of m are on disk and, if they are in the
+// module cache, match the hash the module cache recorded when downloading
+// them against the go.sum entry of the module.
+func (m *goModule) check() error {
+	if m.cache == "" {
+		if _, err := os.Stat(m.Dir); err != nil {
+			return fmt.Errorf("replacement of %s: %s", m.Path, err)
+		}
+		return nil
+	}
+
+	if _, err := os.Stat(m.Dir); err != nil {
+		return fmt.Errorf("%s@%s not found in module cache (%s), run 'go mod download %s'", m.src, m.srcVersion, m.cache, m.src)
+	}
+
+	if m.sum == "" {
+		return fmt.Errorf("missing go.sum entry for %s@%s", m.src, m.srcVersion)
+	}
+
+	ziphash := filepath.Join(m.cache, "cache", "download", filepath.FromSlash(escapeModPath(m.src)), "@v", escapeModPath(m.srcVersion)+".ziphash")
+	data, err := ioutil.ReadFile(ziphash)
+	if err != nil {
+		VLog("cannot verify %s@%s: %s", m.src, m.srcVersion, err)
+		return nil
+	}
+
+	if have := strings.TrimSpace(string(data)); have != m.sum {
+		return fmt.Errorf("%s@%s in module cache does not match go.sum: have %s, want %s", m.src, m.srcVersion, have, m.sum)
+	}
+	return nil
+}
+
+// gxVersion turns a module version into a dms3gx one.
+func gxVersion(v string) string {
+	v = strings.TrimSuffix(v, "+incompatible")
+	return strings.TrimPrefix(v, "v")
+}
+
+// copyModule copies the sources of mod to dst, making them writable as the
+// module cache is read only.
+func copyModule(mod *goModule, dst string) error {
+	return copyTree(mod.Dir, dst)
+}
+
+// copyTree copies the regular files and directories under src to dst,
+// making them writable by their owner.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if fi.IsDir() {
+			return os.MkdirAll(target, fi.Mode().Perm()|0700)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		return copyFile(p, target, fi.Mode().Perm()|0200)
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// the file may be a read only leftover of an earlier copy
+	os.Remove(dst)
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// UseGoModules makes the importer take the modules required by the go.mod
+// in dir from the module cache rather than fetching them. It returns the
+// paths of the modules required directly. Modules missing from the module
+// cache are only an error once imported.
+func (i *Importer) UseGoModules(dir string) ([]string, error) {
+	mods, err := loadGoModules(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var direct []string
+	for _, mod := range mods {
+		if _, err := os.Stat(mod.Dir); err != nil {
+			Log("warning: %s@%s is not in the module cache, skipping it unless it is imported", mod.Path, mod.Version)
+		}
+
+		i.modules[mod.Path] = mod
+		i.modpaths.Add(mod.Path, mod.Path)
+		if !mod.Indirect {
+			direct = append(direct, mod.Path)
+		}
+	}
+	sort.Strings(direct)
+
+	return direct, nil
+}
+
+// baseImport returns the import path of the package imp belongs to: the
+// module providing it if it is known, or its dvcs root otherwise.
+func (i *Importer) baseImport(imp string) string {
+	if mod, _, ok := i.modpaths.Match(imp); ok {
+		return mod
+	}
+	return getBaseDVCS(imp)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	cli "github.com/codegangsta/cli"
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+	. "github.com/whyrusleeping/stump"
+)
+
+var ModInitCommand = cli.Command{
+	Name:  "mod-init",
+	Usage: "generate a go.mod from the dependencies in package.json",
+	Description: `writes a go.mod for the current package requiring the dvcs import
+path of every dms3gx dependency, with replace directives pointing at the
+locally installed packages, then rewrites imports back to their dvcs paths.
+
+Each locally installed dependency gets a minimal go.mod and has its imports
+rewritten as well. Dependencies only found in the global install path are
+left alone and get no replace directive, so the go tool resolves them
+itself, and are left out of go.mod if their version is no module version;
+install them locally with 'dms3gx install --local' first to use the dms3gx
+packages.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "overwrite an existing go.mod",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := dms3gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkg, err := LoadPackageFile(filepath.Join(root, dms3gx.PkgFileName))
+		if err != nil {
+			return err
+		}
+
+		if pkg.Dms3Gx.DvcsImport == "" {
+			return fmt.Errorf("package %s has no dvcs import set", pkg.Name)
+		}
+
+		modfile := filepath.Join(root, "go.mod")
+		if _, err := os.Stat(modfile); err == nil && !c.Bool("force") {
+			return fmt.Errorf("%s already exists, pass --force to overwrite it", modfile)
+		}
+
+		pkgdir := filepath.Join(root, vendorDir)
+		reqs, err := collectModRequires(pkg, pkgdir)
+		if err != nil {
+			return err
+		}
+
+		mapping := make(map[string]string)
+		err = buildRewriteMapping(pkg, pkgdir, mapping, true)
+		if err != nil {
+			return fmt.Errorf("build of rewrite mapping failed:\n%s", err)
+		}
+
+		reqs = localModRequires(root, reqs)
+		for _, req := range reqs {
+			if !req.Local {
+				continue
+			}
+
+			if err := initDepModule(req, mapping); err != nil {
+				return fmt.Errorf("preparing %s: %s", req.Path, err)
+			}
+		}
+
+		err = ioutil.WriteFile(modfile, formatGoMod(root, pkg.Dms3Gx.DvcsImport, reqs), 0644)
+		if err != nil {
+			return err
+		}
+		Log("wrote %s", modfile)
+
+		return doRewrite(pkg, root, mapping, rewriteOptions{})
+	},
+}
+
+// modRequire is a dependency as it appears in a go.mod
+type modRequire struct {
+	Path    string
+	Version string
+
+	// Hash and Dir identify the dms3gx package providing the module
+	Hash string
+	Dir  string
+
+	// Local is set if Dir is within the package, in which case the module
+	// is replaced by it
+	Local bool
+
+	// Exact is set if Version is the dms3gx version of the package, not
+	// one made up to fit the module path
+	Exact bool
+}
+
+// localModRequires marks the requirements installed within root as Local.
+// The others are left to the go tool, which fetches them by version, so
+// those whose version is made up are left out.
+func localModRequires(root string, reqs []*modRequire) []*modRequire {
+	var out []*modRequire
+	for _, req := range reqs {
+		req.Local = strings.HasPrefix(req.Dir, root+string(filepath.Separator))
+		switch {
+		case req.Local:
+		case req.Exact:
+			Log("warning: %s (%s) is not installed locally, leaving it to the go tool", req.Path, req.Hash)
+		default:
+			Log("warning: %s (%s) is not installed locally and its version is no module version, leaving it out of go.mod; install it with 'dms3gx install --local' to require it", req.Path, req.Hash)
+			continue
+		}
+		out = append(out, req)
+	}
+	return out
+}
+
+// collectModRequires lists a module requirement for every dependency of pkg
+// with a dvcs import path, transitive ones included. Like with the rewrite
+// mapping, dependencies of the root package take priority when two
+// packages share an import path.
+func collectModRequires(pkg *Package, pkgdir string) ([]*modRequire, error) {
+	reqs := make(map[string]*modRequire)
+	seen := make(map[string]struct{})
+
+	var process func(pkg *Package, rootPackage bool) error
+	process = func(pkg *Package, rootPackage bool) error {
+		for _, dep := range pkg.Dependencies {
+			if _, ok := seen[dep.Hash]; ok {
+				continue
+			}
+			seen[dep.Hash] = struct{}{}
+
+			cpkg, pdir, err := findDep(dep, pkgdir)
+			if err != nil {
+				return fmt.Errorf("package %q not found. (dependency of %s)", dep.Name, pkg.Name)
+			}
+
+			imp := cpkg.Dms3Gx.DvcsImport
+			if imp == "" {
+				Log("warning: %s (%s) has no dvcs import set, skipping it", dep.Name, dep.Hash)
+			} else if prev, ok := reqs[imp]; !ok || rootPackage {
+				if ok && prev.Hash != dep.Hash {
+					VLog("using %s for %s instead of %s", dep.Hash, imp, prev.Hash)
+				}
+				version, exact := modVersion(imp, cpkg.Version)
+				reqs[imp] = &modRequire{
+					Path:    imp,
+					Version: version,
+					Hash:    dep.Hash,
+					Dir:     filepath.Join(pdir, cpkg.Name),
+					Exact:   exact,
+				}
+			} else if prev.Hash != dep.Hash {
+				VLog("ignoring %s for %s, already using %s", dep.Hash, imp, prev.Hash)
+			}
+
+			if err := process(cpkg, false); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := process(pkg, true); err != nil {
+		return nil, err
+	}
+
+	var out []*modRequire
+	for _, req := range reqs {
+		out = append(out, req)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Path < out[j].Path
+	})
+	return out, nil
+}
+
+var modSemver = regexp.MustCompile(`^([0-9]+)\.[0-9]+\.[0-9]+$`)
+
+// modPathMajor matches the major version suffix of a module path: '/vN' from
+// v2 on, or '.vN' for gopkg.in paths
+var modPathMajor = regexp.MustCompile(`(?:/v([2-9]|[1-9][0-9]+)|^gopkg\.in/.*\.v(0|[1-9][0-9]*))$`)
+
+// pathMajor returns the major version the suffix of module path mod requires
+// its versions to have, or "" if it has no such suffix.
+func pathMajor(mod string) string {
+	m := modPathMajor.FindStringSubmatch(mod)
+	if m == nil {
+		return ""
+	}
+	return m[1] + m[2]
+}
+
+// modVersion turns the dms3gx version v of module mod into a module version,
+// and reports whether it is v itself. A module's major version has to match
+// the suffix of its path: v0 or v1 without one, vN with a '/vN' or '.vN'
+// suffix. Versions that do not fit fall back to vN.0.0 of the major version
+// the path allows, which only means something for modules replaced by a
+// local directory.
+func modVersion(mod, v string) (string, bool) {
+	major := pathMajor(mod)
+
+	m := modSemver.FindStringSubmatch(v)
+	switch {
+	case m == nil:
+	case major == "" && (m[1] == "0" || m[1] == "1"):
+		return "v" + v, true
+	case major != "" && m[1] == major:
+		return "v" + v, true
+	}
+
+	if major == "" {
+		return "v0.0.0", false
+	}
+	return "v" + major + ".0.0", false
+}
+
+// initDepModule prepares the locally installed dependency req for use as a
+// replacement module: it gets a go.mod if it has none, and its imports are
+// rewritten according to mapping.
+func initDepModule(req *modRequire, mapping map[string]string) error {
+	modfile := filepath.Join(req.Dir, "go.mod")
+	if _, err := os.Stat(modfile); os.IsNotExist(err) {
+		data := []byte(fmt.Sprintf("module %s\n", req.Path))
+		if err := ioutil.WriteFile(modfile, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	VLog("  - rewriting imports of %s", req.Path)
+	return runRewrite(req.Dir, rewriteMapper(mapping), goFileFilter, rewriteOptions{})
+}
+
+func formatGoMod(root, modpath string, reqs []*modRequire) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "module %s\n", modpath)
+	if len(reqs) == 0 {
+		return buf.Bytes()
+	}
+
+	fmt.Fprintf(buf, "\nrequire (\n")
+	for _, req := range reqs {
+		fmt.Fprintf(buf, "\t%s %s // dms3gx %s\n", req.Path, req.Version, req.Hash)
+	}
+	fmt.Fprintf(buf, ")\n")
+
+	var local []*modRequire
+	for _, req := range reqs {
+		if req.Local {
+			local = append(local, req)
+		}
+	}
+	if len(local) == 0 {
+		return buf.Bytes()
+	}
+
+	fmt.Fprintf(buf, "\nreplace (\n")
+	for _, req := range local {
+		fmt.Fprintf(buf, "\t%s => %s\n", req.Path, modReplacePath(root, req.Dir))
+	}
+	fmt.Fprintf(buf, ")\n")
+
+	return buf.Bytes()
+}
+
+// modReplacePath returns dir in the form expected by a replace directive in
+// root/go.mod: relative paths have to start with './' or '../'.
+func modReplacePath(root, dir string) string {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return dir
+	}
+	return "./" + filepath.ToSlash(rel)
+}
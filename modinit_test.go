@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestModVersion(t *testing.T) {
+	for _, tc := range []struct {
+		mod, v, want string
+		exact        bool
+	}{
+		{"github.com/x/y", "1.2.3", "v1.2.3", true},
+		{"github.com/x/y", "0.4.0", "v0.4.0", true},
+		{"github.com/x/y", "2.0.0", "v0.0.0", false},
+		{"github.com/x/y/v2", "2.1.0", "v2.1.0", true},
+		{"github.com/x/y/v2", "1.0.0", "v2.0.0", false},
+		{"gopkg.in/yaml.v2", "2.2.8", "v2.2.8", true},
+		{"github.com/x/y", "1.2", "v0.0.0", false},
+	} {
+		got, exact := modVersion(tc.mod, tc.v)
+		if got != tc.want || exact != tc.exact {
+			t.Errorf("modVersion(%q, %q) = %q, %v, want %q, %v", tc.mod, tc.v, got, exact, tc.want, tc.exact)
+		}
+	}
+}
+
+func TestLocalModRequires(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "pkg")
+	global := t.TempDir()
+
+	reqs := localModRequires(root, []*modRequire{
+		{Path: "github.com/x/local", Version: "v0.0.0", Hash: "QmL", Dir: filepath.Join(root, vendorDir, "QmL", "local")},
+		{Path: "github.com/x/exact", Version: "v1.2.3", Hash: "QmE", Dir: filepath.Join(global, "QmE", "exact"), Exact: true},
+		{Path: "github.com/x/madeup", Version: "v0.0.0", Hash: "QmM", Dir: filepath.Join(global, "QmM", "madeup")},
+	})
+
+	if len(reqs) != 2 || reqs[0].Path != "github.com/x/local" || reqs[1].Path != "github.com/x/exact" {
+		t.Fatalf("expected local and exact to be required, got %v", reqs)
+	}
+	if !reqs[0].Local || reqs[1].Local {
+		t.Errorf("expected only local to be replaced")
+	}
+
+	want := "module github.com/x/app\n\nrequire (\n" +
+		"\tgithub.com/x/local v0.0.0 // dms3gx QmL\n" +
+		"\tgithub.com/x/exact v1.2.3 // dms3gx QmE\n" +
+		")\n\nreplace (\n" +
+		"\tgithub.com/x/local => ./" + filepath.ToSlash(filepath.Join(vendorDir, "QmL", "local")) + "\n" +
+		")\n"
+	if got := string(formatGoMod(root, "github.com/x/app", reqs)); got != want {
+		t.Errorf("got go.mod:\n%s\nwant:\n%s", got, want)
+	}
+}
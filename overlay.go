@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	cli "github.com/codegangsta/cli"
+	rw "github.com/dms3-why/dms3gx-go/rewrite"
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+	. "github.com/whyrusleeping/stump"
+)
+
+// setting this makes the test hooks build through an overlay instead of
+// rewriting the tree. The hooks run as separate processes, so the pre-test
+// and post-test hooks only agree with the test hook through the environment.
+const overlayEnvVar = "DMS3GX_GO_OVERLAY"
+
+var BuildCommand = cli.Command{
+	Name:            "build",
+	Usage:           "run 'go build' against dms3gx imports without rewriting the tree",
+	ArgsUsage:       "[go build flags and packages]",
+	SkipFlagParsing: true,
+	Action: func(c *cli.Context) error {
+		return goWithOverlay("build", c.Args())
+	},
+}
+
+var TestCommand = cli.Command{
+	Name:            "test",
+	Usage:           "run 'go test' against dms3gx imports without rewriting the tree",
+	ArgsUsage:       "[go test flags and packages]",
+	SkipFlagParsing: true,
+	Action: func(c *cli.Context) error {
+		return goWithOverlay("test", c.Args())
+	},
+}
+
+// useOverlay reports whether the test hooks should run through an overlay.
+func useOverlay() bool {
+	return os.Getenv(overlayEnvVar) != ""
+}
+
+// goWithOverlay runs the given go tool command for the current package with
+// every import rewritten to its dms3gx path. The rewritten files only exist
+// in a temporary directory handed to the go tool through '-overlay'.
+func goWithOverlay(verb string, args []string) error {
+	root, err := dms3gx.GetPackageRoot()
+	if err != nil {
+		return err
+	}
+
+	pkg, err := LoadPackageFile(filepath.Join(root, dms3gx.PkgFileName))
+	if err != nil {
+		return err
+	}
+
+	VLog("  - building rewrite mapping")
+	mapping := make(map[string]string)
+	err = buildRewriteMapping(pkg, filepath.Join(root, vendorDir), mapping, false)
+	if err != nil {
+		return fmt.Errorf("build of rewrite mapping failed:\n%s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "dms3gx-go-overlay")
+	if err != nil {
+		return fmt.Errorf("creating overlay dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	overlay, err := writeOverlay(root, dir, mapping)
+	if err != nil {
+		return err
+	}
+
+	// the go tool resolves overlay paths against its working directory,
+	// which has to be spelled without symlinks to match them
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	wd, err = filepath.EvalSymlinks(wd)
+	if err != nil {
+		return err
+	}
+
+	goargs := append([]string{verb, "-overlay=" + overlay}, args...)
+	VLog("  - running go %s in %s", goargs, wd)
+	cmd := exec.Command("go", goargs...)
+	cmd.Dir = wd
+	cmd.Env = append(os.Environ(), "PWD="+wd)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// writeOverlay writes the files under root rewritten according to mapping
+// into dir, along with the overlay file describing them for the go tool,
+// and returns the path of the latter.
+func writeOverlay(root, dir string, mapping map[string]string) (string, error) {
+	// files that don't parse are left as they are, for the go tool to
+	// report
+	opts := rw.Options{SkipErrors: true}
+	res, replace, err := rw.OverlayImports(root, rewriteMapper(mapping), goFileFilter, opts, filepath.Join(dir, "src"))
+	if err != nil {
+		return "", err
+	}
+	VLog("  - %d of %d files rewritten in overlay", res.Changed, res.Scanned)
+	for _, fe := range res.Skipped {
+		VLog("  - left out of the overlay: %s", fe)
+	}
+
+	data, err := json.Marshal(struct {
+		Replace map[string]string
+	}{replace})
+	if err != nil {
+		return "", err
+	}
+
+	overlay := filepath.Join(dir, "overlay.json")
+	if err := ioutil.WriteFile(overlay, data, 0644); err != nil {
+		return "", err
+	}
+
+	return overlay, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteOverlaySkipsBadFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"a.go":     "package a\n\nimport \"github.com/x/lib\"\n\nvar _ = lib.L\n",
+		"sub/b.go": "package sub\n\nimport (\n",
+	})
+
+	dir := t.TempDir()
+	overlay, err := writeOverlay(root, dir, map[string]string{"github.com/x/lib": dms3gxImport("QmLib", "lib")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(overlay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ov struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(data, &ov); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ov.Replace) != 1 {
+		t.Fatalf("expected only a.go in the overlay, got %v", ov.Replace)
+	}
+	out, ok := ov.Replace[filepath.Join(resolved, "a.go")]
+	if !ok {
+		t.Fatalf("a.go is not in the overlay: %v", ov.Replace)
+	}
+
+	src, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(src), `"`+dms3gxImport("QmLib", "lib")+`"`) {
+		t.Errorf("a.go was not rewritten in the overlay:\n%s", src)
+	}
+}
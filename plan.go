@@ -0,0 +1,313 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+	. "github.com/whyrusleeping/stump"
+)
+
+// importStep is a package an import would go through
+type importStep struct {
+	Import string
+
+	// Hash is set for packages satisfied by the --map document, which are
+	// fetched instead of published, and for packages Published already by
+	// an earlier run of a resumed import
+	Hash      string
+	Published bool
+
+	// Name the package would be published under, and whether it comes
+	// from an existing package file
+	Name           string
+	HasPackageFile bool
+	Version        string
+
+	// dvcs import paths of the packages it depends on
+	Deps []string
+
+	// module the sources were taken from, if any
+	mod *goModule
+}
+
+// Plan discovers the packages importing imppaths would publish, the same
+// way Dms3GxPublishGoPackage does, without initializing, rewriting or
+// publishing any of them. Sources are still fetched into the GOPATH, as
+// dependencies are found by reading them. Packages to publish are returned
+// in publish order, each after its dependencies.
+func (i *Importer) Plan(imppaths []string) ([]*importStep, error) {
+	var steps []*importStep
+	seen := make(map[string]*importStep)
+
+	var visit func(imppath string) (*importStep, error)
+	visit = func(imppath string) (*importStep, error) {
+		imppath = i.baseImport(imppath)
+		if s, ok := seen[imppath]; ok {
+			return s, nil
+		}
+
+		s := &importStep{Import: imppath}
+		seen[imppath] = s
+
+		if d, ok := i.published(imppath); ok {
+			s.Hash = d.Hash
+			s.Name = d.Name
+			s.Version = d.Version
+			s.Published = true
+			steps = append(steps, s)
+			return s, nil
+		}
+
+		if hash, ok := i.preMap[imppath]; ok {
+			s.Hash = hash
+			steps = append(steps, s)
+			return s, nil
+		}
+
+		pkgpath := path.Join(i.gopath, "src", imppath)
+		mod, err := i.fetch(imppath, pkgpath)
+		if err != nil {
+			return nil, err
+		}
+
+		pkg, err := LoadPackageFile(path.Join(pkgpath, dms3gx.PkgFileName))
+		switch {
+		case err == nil:
+			s.Name = pkg.Name
+			s.Version = pkg.Version
+			s.HasPackageFile = true
+		case os.IsNotExist(err):
+			parts := strings.Split(imppath, "/")
+			s.Name = parts[len(parts)-1]
+		default:
+			return nil, err
+		}
+		if mod != nil {
+			s.Version = gxVersion(mod.Version)
+			s.mod = mod
+		}
+
+		deps, err := i.DepsToVendorForPackage(imppath)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching deps for %s: %s", imppath, err)
+		}
+
+		for _, child := range deps {
+			if isSubImport(child, imppath) {
+				continue
+			}
+
+			cs, err := visit(child)
+			if err != nil {
+				return nil, err
+			}
+			s.Deps = append(s.Deps, cs.Import)
+		}
+
+		steps = append(steps, s)
+		return s, nil
+	}
+
+	for _, imp := range imppaths {
+		if _, err := visit(imp); err != nil {
+			return nil, err
+		}
+	}
+	return steps, nil
+}
+
+// writeImportPlan prints the packages to publish in order, followed by
+// those satisfied by the --map document.
+func writeImportPlan(w io.Writer, steps []*importStep) {
+	var mapped, published []*importStep
+	tw := tabwriter.NewWriter(w, 4, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "#\tNAME\tIMPORT\tPACKAGE FILE\tDEPENDENCIES\n")
+
+	n := 0
+	for _, s := range steps {
+		if s.Published {
+			published = append(published, s)
+			continue
+		}
+		if s.Hash != "" {
+			mapped = append(mapped, s)
+			continue
+		}
+
+		n++
+		pkgfile := "new"
+		if s.HasPackageFile {
+			pkgfile = "existing"
+		}
+		name := s.Name
+		if s.Version != "" {
+			name += " " + s.Version
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", n, name, s.Import, pkgfile, strings.Join(s.Deps, ", "))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d package(s) to publish\n", n)
+
+	if len(mapped) > 0 {
+		fmt.Fprintf(w, "\nsatisfied by --map:\n")
+		for _, s := range mapped {
+			fmt.Fprintf(w, "  %s %s\n", s.Import, s.Hash)
+		}
+	}
+
+	if len(published) > 0 {
+		fmt.Fprintf(w, "\npublished by the import being resumed:\n")
+		for _, s := range published {
+			fmt.Fprintf(w, "  %s %s\n", s.Import, s.Hash)
+		}
+	}
+}
+
+func planImport(importer *Importer, imppaths []string) error {
+	steps, err := importer.Plan(imppaths)
+	if err != nil {
+		return err
+	}
+
+	writeImportPlan(os.Stdout, steps)
+	return nil
+}
+
+// importConcurrently fetches all the packages importing imppaths needs, then
+// publishes them with up to jobs publishes running at once. Fetching is done
+// one package at a time, as fetchers write to a shared GOPATH.
+func importConcurrently(importer *Importer, imppaths []string, jobs int) error {
+	steps, err := importer.Plan(imppaths)
+	if err != nil {
+		return err
+	}
+
+	Log("publishing %d packages, %d at a time", len(steps), jobs)
+	return importer.PublishPlan(steps, jobs)
+}
+
+// PublishPlan publishes the packages of a plan made by Plan, up to jobs of
+// them at once. A package is only published once all of its dependencies
+// are. Package files are created up front, as creating them may prompt for
+// a name.
+func (i *Importer) PublishPlan(steps []*importStep, jobs int) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	planned := make(map[string]bool)
+	for _, s := range steps {
+		for _, d := range s.Deps {
+			if !planned[d] {
+				return fmt.Errorf("import cycle between %s and %s", s.Import, d)
+			}
+		}
+		planned[s.Import] = true
+	}
+
+	pkgs := make(map[string]*Package)
+	for _, s := range steps {
+		if s.Hash != "" {
+			continue
+		}
+
+		pkg, err := i.loadOrInitPackage(s.Import, path.Join(i.gopath, "src", s.Import), s.mod)
+		if err != nil {
+			return err
+		}
+		pkgs[s.Import] = pkg
+	}
+
+	done := make(map[string]chan struct{})
+	for _, s := range steps {
+		done[s.Import] = make(chan struct{})
+	}
+
+	// a package nested in the directory of another, like a module and
+	// its /v2 inside it, is rewritten and published along with it, so
+	// they are published one at a time
+	nested := make(map[string]*sync.Mutex)
+	for _, s := range steps {
+		outer := s.Import
+		for _, o := range steps {
+			if len(o.Import) < len(outer) && isSubImport(s.Import, o.Import) {
+				outer = o.Import
+			}
+		}
+		if nested[outer] == nil {
+			nested[outer] = new(sync.Mutex)
+		}
+		nested[s.Import] = nested[outer]
+	}
+
+	var wg sync.WaitGroup
+	var errLock sync.Mutex
+	var perr error
+	sem := make(chan struct{}, jobs)
+
+	for _, s := range steps {
+		wg.Add(1)
+		go func(s *importStep) {
+			defer wg.Done()
+			defer close(done[s.Import])
+
+			for _, d := range s.Deps {
+				<-done[d]
+			}
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			nested[s.Import].Lock()
+			defer nested[s.Import].Unlock()
+
+			errLock.Lock()
+			failed := perr != nil
+			errLock.Unlock()
+			if failed {
+				return
+			}
+
+			if err := i.publishStep(s, pkgs[s.Import]); err != nil {
+				errLock.Lock()
+				if perr == nil {
+					perr = fmt.Errorf("importing %s: %s", s.Import, err)
+				}
+				errLock.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	return perr
+}
+
+// publishStep publishes the package of s, whose dependencies must all be
+// published.
+func (i *Importer) publishStep(s *importStep, pkg *Package) error {
+	switch {
+	case s.Published:
+		return nil
+	case s.Hash != "":
+		_, err := i.getMapped(s.Import, s.Hash)
+		return err
+	}
+
+	for _, d := range s.Deps {
+		dep, ok := i.published(d)
+		if !ok {
+			return fmt.Errorf("dependency %s was not published", d)
+		}
+		pkg.Dependencies = append(pkg.Dependencies, dep)
+	}
+
+	_, err := i.publish(s.Import, path.Join(i.gopath, "src", s.Import), pkg)
+	return err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+)
+
+func TestPublishPlanConcurrently(t *testing.T) {
+	chdirTemp(t)
+	importer, pm := newTestImporter(t)
+
+	steps, err := importer.Plan([]string{"github.com/x/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pm.published) != 0 {
+		t.Fatalf("planning published %v", pm.published)
+	}
+
+	if err := importer.PublishPlan(steps, 4); err != nil {
+		t.Fatal(err)
+	}
+	checkImported(t, importer, pm)
+}
+
+// nestingPM is a localPM failing the test if it is asked to publish a
+// directory nested in one it is publishing already.
+type nestingPM struct {
+	*localPM
+	t *testing.T
+
+	lk     sync.Mutex
+	active map[string]bool
+}
+
+func (pm *nestingPM) PublishPackage(dir string, pkg *dms3gx.PackageBase) (string, error) {
+	pm.lk.Lock()
+	for d := range pm.active {
+		if isSubImport(filepath.ToSlash(dir), filepath.ToSlash(d)) || isSubImport(filepath.ToSlash(d), filepath.ToSlash(dir)) {
+			pm.t.Errorf("published %s while publishing %s", dir, d)
+		}
+	}
+	pm.active[dir] = true
+	pm.lk.Unlock()
+
+	// give other publishes time to overlap
+	time.Sleep(20 * time.Millisecond)
+
+	defer func() {
+		pm.lk.Lock()
+		delete(pm.active, dir)
+		pm.lk.Unlock()
+	}()
+	return pm.localPM.PublishPackage(dir, pkg)
+}
+
+func TestPublishPlanNested(t *testing.T) {
+	chdirTemp(t)
+	gopathMode(t)
+	gopath := t.TempDir()
+	writeFiles(t, gopath, map[string]string{
+		"src/github.com/x/n/n.go":       "package n\n",
+		"src/github.com/x/n/v2/n.go":    "package n\n",
+		"src/github.com/x/n/v2/v3/n.go": "package n\n",
+		"src/github.com/x/other/o.go":   "package other\n",
+	})
+
+	lpm, err := newLocalPM(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := &nestingPM{localPM: lpm, t: t, active: make(map[string]bool)}
+
+	importer, err := NewImporter(true, gopath, nil, pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importer.yesall = true
+
+	// as planned with the module paths of a go.mod
+	steps := []*importStep{
+		{Import: "github.com/x/n/v2/v3"},
+		{Import: "github.com/x/n"},
+		{Import: "github.com/x/other"},
+		{Import: "github.com/x/n/v2"},
+	}
+	if err := importer.PublishPlan(steps, len(steps)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range steps {
+		if _, ok := importer.published(s.Import); !ok {
+			t.Errorf("%s was not published", s.Import)
+		}
+	}
+}
+
+func TestPlanResumed(t *testing.T) {
+	wd := chdirTemp(t)
+	importer, _ := newTestImporter(t)
+
+	state := filepath.Join(wd, "state.json")
+	args := importArgs{Package: "github.com/x/app"}
+	if err := importer.UseStateFile(state, false, args); err != nil {
+		t.Fatal(err)
+	}
+
+	// interrupted after publishing lib2
+	if _, err := importer.Dms3GxPublishGoPackage("github.com/x/lib2"); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, pm := newTestImporter(t)
+	if err := resumed.UseStateFile(state, true, args); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := resumed.Plan([]string{"github.com/x/app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	writeImportPlan(buf, steps)
+	plan := buf.String()
+
+	lib2, _ := importer.published("github.com/x/lib2")
+	for _, want := range []string{
+		"3 package(s) to publish",
+		"satisfied by --map:\n  github.com/x/mapped ",
+		"published by the import being resumed:\n  github.com/x/lib2 " + lib2.Hash + "\n",
+	} {
+		if !strings.Contains(plan, want) {
+			t.Errorf("plan does not contain %q:\n%s", want, plan)
+		}
+	}
+
+	if err := resumed.PublishPlan(steps, 2); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range pm.published {
+		if name == "lib2" {
+			t.Error("resumed import published lib2 again")
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+	. "github.com/whyrusleeping/stump"
+)
+
+// PackageManager publishes and fetches packages for the importer. It is
+// implemented by *dms3gx.PM, which talks to the dms3gx daemon, and by
+// localPM. Implementations must be safe for concurrent use, as PublishPlan
+// publishes several packages at once.
+type PackageManager interface {
+	PublishPackage(dir string, pkg *dms3gx.PackageBase) (string, error)
+	GetPackageTo(hash, out string) (*dms3gx.Package, error)
+	InitPkg(dir, name, lang string, setup func(*dms3gx.Package)) error
+}
+
+// daemonPM makes *dms3gx.PM safe for concurrent use. The PM connects to
+// the daemon lazily, without locking, on the first call that needs it, so
+// the first call to publish or fetch a package is made alone. Later calls
+// overlap freely.
+type daemonPM struct {
+	pm   PackageManager
+	once sync.Once
+}
+
+// call makes call alone if it is the first to reach the daemon, and like
+// any other call otherwise.
+func (d *daemonPM) call(call func()) {
+	first := false
+	d.once.Do(func() {
+		first = true
+		call()
+	})
+	if !first {
+		call()
+	}
+}
+
+func (d *daemonPM) PublishPackage(dir string, pkg *dms3gx.PackageBase) (hash string, err error) {
+	d.call(func() { hash, err = d.pm.PublishPackage(dir, pkg) })
+	return hash, err
+}
+
+func (d *daemonPM) GetPackageTo(hash, out string) (pkg *dms3gx.Package, err error) {
+	d.call(func() { pkg, err = d.pm.GetPackageTo(hash, out) })
+	return pkg, err
+}
+
+func (d *daemonPM) InitPkg(dir, name, lang string, setup func(*dms3gx.Package)) error {
+	return d.pm.InitPkg(dir, name, lang, setup)
+}
+
+// localPM stores packages in a directory, under '<dir>/<hash>/<name>' like
+// installed packages, keyed by a hash of their contents computed locally.
+// It needs no daemon, so imports can be tried out offline. It is safe for
+// concurrent use.
+type localPM struct {
+	dir string
+}
+
+func newLocalPM(dir string) (*localPM, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localPM{dir: dir}, nil
+}
+
+// PublishPackage copies the files of the package in dir, minus those
+// matched by its .dms3-gxignore, to the store. The package file in dir must
+// be up to date.
+func (pm *localPM) PublishPackage(dir string, pkg *dms3gx.PackageBase) (string, error) {
+	files, err := publishedFiles(dir)
+	if err != nil {
+		return "", err
+	}
+
+	hash, err := contentHash(dir, files)
+	if err != nil {
+		return "", err
+	}
+
+	dst := filepath.Join(pm.dir, hash, pkg.Name)
+	if _, err := os.Stat(dst); err == nil {
+		VLog("  - %s is already in %s", hash, pm.dir)
+		return hash, nil
+	}
+
+	// copy to a temporary location first so an interrupted publish
+	// leaves nothing behind, and concurrent publishes of the same
+	// contents don't write over each other
+	tmp, err := ioutil.TempDir(pm.dir, hash+".")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	for _, f := range files {
+		fi, err := os.Stat(filepath.Join(dir, f))
+		if err != nil {
+			return "", err
+		}
+
+		target := filepath.Join(tmp, pkg.Name, f)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return "", err
+		}
+		if err := copyFile(filepath.Join(dir, f), target, fi.Mode().Perm()); err != nil {
+			return "", err
+		}
+	}
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, filepath.Join(pm.dir, hash)); err != nil {
+		// lost the race to another publish of the same contents
+		if _, serr := os.Stat(dst); serr == nil {
+			return hash, nil
+		}
+		return "", err
+	}
+	return hash, nil
+}
+
+// GetPackageTo copies the package with the given hash from the store to
+// out, which ends up laid out like '<out>/<name>'.
+func (pm *localPM) GetPackageTo(hash, out string) (*dms3gx.Package, error) {
+	src := filepath.Join(pm.dir, hash)
+
+	var pkg dms3gx.Package
+	if err := dms3gx.FindPackageInDir(&pkg, src); err != nil {
+		return nil, fmt.Errorf("%s not found in %s: %s", hash, pm.dir, err)
+	}
+
+	if err := copyTree(src, out); err != nil {
+		return nil, err
+	}
+	return &pkg, nil
+}
+
+// InitPkg writes a new package file to dir, then does what the post-init
+// hook would.
+func (pm *localPM) InitPkg(dir, name, lang string, setup func(*dms3gx.Package)) error {
+	pkgfile := filepath.Join(dir, dms3gx.PkgFileName)
+
+	base := &dms3gx.Package{
+		PackageBase: dms3gx.PackageBase{
+			Name:     name,
+			Language: lang,
+			Version:  "0.0.0",
+		},
+	}
+	if setup != nil {
+		setup(base)
+	}
+	if err := dms3gx.SavePackageFile(base, pkgfile); err != nil {
+		return err
+	}
+
+	pkg, err := LoadPackageFile(pkgfile)
+	if err != nil {
+		return err
+	}
+
+	if imp, _ := packagesGoImport(dir); imp != "" {
+		pkg.Dms3Gx.DvcsImport = imp
+	}
+	return dms3gx.SavePackageFile(pkg, pkgfile)
+}
+
+// publishedFiles returns the paths, relative to dir, of the regular files
+// to publish from dir in sorted order. Dvcs metadata is skipped along with
+// files matching a pattern in the package's .dms3-gxignore.
+func publishedFiles(dir string) ([]string, error) {
+	ignore, err := readDms3GxIgnore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ignored := func(rel string) bool {
+		for _, pat := range ignore {
+			if ok, _ := filepath.Match(pat, rel); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	var files []string
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if fi.IsDir() {
+			switch {
+			case rel == ".":
+				return nil
+			case fi.Name() == ".git", fi.Name() == ".hg", ignored(rel):
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if fi.Mode().IsRegular() && !ignored(rel) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+func readDms3GxIgnore(dir string) ([]string, error) {
+	fi, err := os.Open(filepath.Join(dir, ".dms3-gxignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	var pats []string
+	scan := bufio.NewScanner(fi)
+	for scan.Scan() {
+		if line := strings.TrimSpace(scan.Text()); line != "" {
+			pats = append(pats, line)
+		}
+	}
+	return pats, scan.Err()
+}
+
+// contentHash hashes the names, modes and contents of the given files
+// under dir. files must be sorted.
+func contentHash(dir string, files []string) (string, error) {
+	h := sha256.New()
+	for _, f := range files {
+		fpath := filepath.Join(dir, filepath.FromSlash(f))
+		fi, err := os.Stat(fpath)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%s\x00%o\x00", f, fi.Mode().Perm())
+		binary.Write(h, binary.BigEndian, fi.Size())
+
+		in, err := os.Open(fpath)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, in)
+		in.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+)
+
+func TestLocalPMConcurrentPublish(t *testing.T) {
+	pm, err := newLocalPM(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	files := map[string]string{"sub/b.go": "package sub\n"}
+	for k := 0; k < 100; k++ {
+		files[fmt.Sprintf("a%d.go", k)] = "package a\n"
+	}
+	writeFiles(t, dir, files)
+	if err := pm.InitPkg(dir, "a", "go", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 16
+	hashes := make([]string, n)
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for k := 0; k < n; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			hashes[k], errs[k] = pm.PublishPackage(dir, &dms3gx.PackageBase{Name: "a"})
+		}(k)
+	}
+	wg.Wait()
+
+	for k := 0; k < n; k++ {
+		if errs[k] != nil {
+			t.Fatal(errs[k])
+		}
+		if hashes[k] != hashes[0] {
+			t.Errorf("publishes disagree on the hash: %s and %s", hashes[0], hashes[k])
+		}
+	}
+
+	ents, err := ioutil.ReadDir(pm.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) != 1 || ents[0].Name() != hashes[0] {
+		var names []string
+		for _, e := range ents {
+			names = append(names, e.Name())
+		}
+		t.Errorf("expected only %s in the store, found %v", hashes[0], names)
+	}
+
+	out := t.TempDir()
+	pkg, err := pm.GetPackageTo(hashes[0], out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Name != "a" {
+		t.Errorf("got package %q from the store", pkg.Name)
+	}
+	checkFile(t, filepath.Join(out, "a", "sub", "b.go"), "package sub\n")
+}
+
+func checkFile(t *testing.T, p, want string) {
+	t.Helper()
+	got, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("%s:\ngot:\n%s\nwant:\n%s", p, got, want)
+	}
+}
+
+// countingPM is a localPM recording the start and end of each publish, and
+// how many were in flight at most.
+type countingPM struct {
+	*localPM
+
+	lk       sync.Mutex
+	inflight int
+	max      int
+	events   []string
+}
+
+func (pm *countingPM) PublishPackage(dir string, pkg *dms3gx.PackageBase) (string, error) {
+	pm.lk.Lock()
+	pm.inflight++
+	if pm.inflight > pm.max {
+		pm.max = pm.inflight
+	}
+	pm.events = append(pm.events, "start "+pkg.Name)
+	pm.lk.Unlock()
+
+	// give other publishes time to overlap
+	time.Sleep(20 * time.Millisecond)
+	hash, err := pm.localPM.PublishPackage(dir, pkg)
+
+	pm.lk.Lock()
+	pm.inflight--
+	pm.events = append(pm.events, "end "+pkg.Name)
+	pm.lk.Unlock()
+	return hash, err
+}
+
+func TestDaemonPMOverlapsPublishes(t *testing.T) {
+	chdirTemp(t)
+	gopathMode(t)
+	gopath := t.TempDir()
+
+	var steps []*importStep
+	files := make(map[string]string)
+	for k := 0; k < 6; k++ {
+		imp := fmt.Sprintf("github.com/x/p%d", k)
+		files["src/"+imp+"/p.go"] = "package p\n"
+		steps = append(steps, &importStep{Import: imp})
+	}
+	writeFiles(t, gopath, files)
+
+	lpm, err := newLocalPM(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm := &countingPM{localPM: lpm}
+
+	importer, err := NewImporter(true, gopath, nil, &daemonPM{pm: pm})
+	if err != nil {
+		t.Fatal(err)
+	}
+	importer.yesall = true
+
+	if err := importer.PublishPlan(steps, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if pm.max < 2 {
+		t.Errorf("at most %d publishes were in flight with 3 jobs", pm.max)
+	}
+	if pm.max > 3 {
+		t.Errorf("%d publishes were in flight with 3 jobs", pm.max)
+	}
+
+	// the first publish, which connects to the daemon, is alone
+	if len(pm.events) < 2 || !strings.HasPrefix(pm.events[0], "start ") ||
+		pm.events[1] != "end "+strings.TrimPrefix(pm.events[0], "start ") {
+		t.Errorf("the first publish overlapped with others: %v", pm.events)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+
+	cli "github.com/codegangsta/cli"
+	rw "github.com/dms3-why/dms3gx-go/rewrite"
+	. "github.com/whyrusleeping/stump"
+)
+
+var prePublishHookCommand = cli.Command{
+	Name:  "pre-publish",
+	Usage: "hook called before publishing to check the package is in a publishable state",
+	Description: `refuses to publish if:
+
+  - imports of dependencies are not all in the expected form, dvcs paths
+    unless --expect=hash is given
+  - a dependency is linked to a dvcs checkout with 'dms3gx-go link'
+  - an interrupted rewrite left files behind
+  - 'go build ./...' fails with the imports rewritten through an overlay`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "expect",
+			Value: "dvcs",
+			Usage: "form imports of dependencies must be in: dvcs or hash",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		expect := c.String("expect")
+		if expect != "dvcs" && expect != "hash" {
+			return fmt.Errorf("unknown import form %q", expect)
+		}
+
+		g, err := loadRootDepGraph()
+		if err != nil {
+			return err
+		}
+
+		var problems int
+
+		bad, err := g.misformedImports(expect == "hash")
+		if err != nil {
+			return err
+		}
+		for _, imp := range bad {
+			Error("%s:%d: %s is not in %s form", imp.File, imp.Pos.Line, imp.Path, expect)
+			problems++
+		}
+
+		links, err := listLinkedPackages()
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			if n, ok := g.Nodes[l[0]]; ok {
+				Error("dependency %s is linked to %s, run 'dms3gx-go link -r %s'", n, l[1], l[0])
+				problems++
+			}
+		}
+
+		left, err := rw.Leftovers(g.Root.Dir)
+		if err != nil {
+			return err
+		}
+		for _, f := range left {
+			Error("%s was left behind by an interrupted rewrite, run 'dms3gx-go rewrite --recover'", f)
+			problems++
+		}
+
+		if problems > 0 {
+			return fmt.Errorf("refusing to publish, found %d problems", problems)
+		}
+
+		VLog("  - building with rewritten imports")
+		if err := goWithOverlay("build", []string{"./..."}); err != nil {
+			return fmt.Errorf("refusing to publish, build failed: %s", err)
+		}
+
+		return nil
+	},
+}
+
+// misformedImports returns the imports of the root package not in the form
+// expected: imports of dependencies by dvcs path if hashed is set, or else
+// every import by dms3gx path, including those of packages that are no
+// dependency anymore.
+func (g *depGraph) misformedImports(hashed bool) ([]rw.Import, error) {
+	var out []rw.Import
+	if hashed {
+		imps, err := g.depImports()
+		if err != nil {
+			return nil, err
+		}
+		for _, imp := range imps {
+			if !imp.Hashed {
+				out = append(out, imp.Import)
+			}
+		}
+		return out, nil
+	}
+
+	imps, _, err := rw.ListImports(g.Root.Dir, goFileFilter)
+	if err != nil {
+		return nil, err
+	}
+	for _, imp := range imps {
+		if isDms3gxImport(imp.Path) {
+			out = append(out, imp)
+		}
+	}
+	return out, nil
+}
+
+// depImport is an import resolved to a package of the dependency graph.
+type depImport struct {
+	rw.Import
+	Dep *depNode
+
+	// Hashed is set for imports by dms3gx path rather than dvcs path
+	Hashed bool
+}
+
+// depImports returns the imports of the root package pointing into any of
+// its dependencies, by dms3gx or by dvcs import path. Dvcs paths provided by
+// several packages resolve to a direct dependency of the root if possible.
+func (g *depGraph) depImports() ([]depImport, error) {
+	isDirect := make(map[string]bool)
+	for _, h := range g.Root.Deps {
+		isDirect[h] = true
+	}
+
+	m := new(rw.PrefixMap)
+	add := func(direct bool) {
+		for _, n := range g.sortedNodes() {
+			if isDirect[n.Hash] != direct {
+				continue
+			}
+			m.Add(dms3gxImport(n.Hash, n.Name), n.Hash)
+			if n.DvcsImport != "" {
+				m.Add(n.DvcsImport, n.Hash)
+			}
+		}
+	}
+	add(false)
+	add(true)
+
+	imps, _, err := rw.ListImports(g.Root.Dir, goFileFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []depImport
+	for _, imp := range imps {
+		if _, h, ok := m.Match(imp.Path); ok {
+			out = append(out, depImport{
+				Import: imp,
+				Dep:    g.Nodes[h],
+				Hashed: isDms3gxImport(imp.Path),
+			})
+		}
+	}
+	return out, nil
+}
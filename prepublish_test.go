@@ -0,0 +1,61 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+)
+
+func TestMisformedImports(t *testing.T) {
+	root := t.TempDir()
+	pkgdir := filepath.Join(root, vendorDir)
+	writeInstalledPackage(t, pkgdir, "QmLib", newTestPackage("lib", "1.0.0", "github.com/x/lib"), map[string]string{
+		"lib.go": "package lib\n",
+	})
+
+	// old was a dependency before being removed
+	writeFiles(t, root, map[string]string{
+		"hashed.go": "package app\n\nimport _ \"" + dms3gxImport("QmLib", "lib") + "\"\n",
+		"stale.go":  "package app\n\nimport _ \"" + dms3gxImport("QmStale", "old") + "\"\n",
+		"dvcs.go":   "package app\n\nimport (\n\t_ \"fmt\"\n\t_ \"github.com/x/lib\"\n)\n",
+	})
+
+	pkg := newTestPackage("app", "0.1.0", "github.com/x/app", &dms3gx.Dependency{Name: "lib", Hash: "QmLib", Version: "1.0.0"})
+	g, err := loadDepGraph(pkg, root, pkgdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		hashed bool
+		want   map[string]string
+	}{
+		{false, map[string]string{
+			"hashed.go": dms3gxImport("QmLib", "lib"),
+			"stale.go":  dms3gxImport("QmStale", "old"),
+		}},
+		{true, map[string]string{
+			"dvcs.go": "github.com/x/lib",
+		}},
+	} {
+		bad, err := g.misformedImports(tc.hashed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := make(map[string]string)
+		for _, imp := range bad {
+			got[imp.File] = imp.Path
+		}
+		if len(got) != len(bad) || len(got) != len(tc.want) {
+			t.Errorf("hashed %v: got %v, want %v", tc.hashed, bad, tc.want)
+			continue
+		}
+		for f, p := range tc.want {
+			if got[f] != p {
+				t.Errorf("hashed %v: %s imports %q, want %q reported", tc.hashed, f, got[f], p)
+			}
+		}
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	cli "github.com/codegangsta/cli"
+	rw "github.com/dms3-why/dms3gx-go/rewrite"
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+	. "github.com/whyrusleeping/stump"
+)
+
+var ProxyCommand = cli.Command{
+	Name:  "proxy",
+	Usage: "serve installed dms3gx packages over the GOPROXY protocol",
+	Description: `serves every package installed under $GOPATH/src/<namespace> as a go
+module, using its dvcs import path as module path and its version as module
+version. Imports of other dms3gx packages are rewritten back to their dvcs
+paths, and a go.mod requiring the package's dependencies is generated.
+
+Example:
+
+> dms3gx-go proxy --addr localhost:8081 &
+> GOPROXY=http://localhost:8081 GONOSUMDB=* go build ./...`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "addr",
+			Value: "localhost:8081",
+			Usage: "address to listen on",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		p, err := newModProxy(globalPath())
+		if err != nil {
+			return err
+		}
+
+		addr := c.String("addr")
+		Log("serving %d modules from %s on http://%s", p.count(), p.root, addr)
+		return http.ListenAndServe(addr, p)
+	},
+}
+
+// proxyVersion is a dms3gx package served as a module version
+type proxyVersion struct {
+	Module  string
+	Version string
+	Hash    string
+	Pkg     *Package
+
+	// Dir is the directory of the package, '<root>/<hash>/<name>'
+	Dir  string
+	Time time.Time
+}
+
+func (v *proxyVersion) incompatible() bool {
+	return strings.HasSuffix(v.Version, "+incompatible")
+}
+
+// a request for an unknown module only rescans the packages if the last scan
+// is older than this, so that misses, which are common when the proxy is
+// one of several in GOPROXY, do not rescan every time
+const proxyRescanInterval = 5 * time.Second
+
+// modProxy serves the dms3gx packages installed under root over the module
+// proxy protocol.
+type modProxy struct {
+	root string
+
+	lk sync.Mutex
+	// module path -> module version -> package
+	modules map[string]map[string]*proxyVersion
+	scanned time.Time
+}
+
+func newModProxy(root string) (*modProxy, error) {
+	p := &modProxy{root: root}
+	if err := p.reindex(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// reindex scans root for installed packages.
+func (p *modProxy) reindex() error {
+	start := time.Now()
+	dirents, err := ioutil.ReadDir(p.root)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	modules := make(map[string]map[string]*proxyVersion)
+	for _, e := range dirents {
+		hash := e.Name()
+
+		var pkg Package
+		if err := dms3gx.FindPackageInDir(&pkg, filepath.Join(p.root, hash)); err != nil {
+			VLog("proxy: skipping %s: %s", hash, err)
+			continue
+		}
+
+		imp := pkg.Dms3Gx.DvcsImport
+		if imp == "" {
+			VLog("proxy: skipping %s: no dvcs import set", hash)
+			continue
+		}
+
+		version, ok := proxyModVersion(imp, pkg.Version)
+		if !ok {
+			VLog("proxy: skipping %s: version %q of %s is not a valid module version", hash, pkg.Version, imp)
+			continue
+		}
+
+		dir := filepath.Join(p.root, hash, pkg.Name)
+		var mtime time.Time
+		if fi, err := os.Stat(filepath.Join(dir, dms3gx.PkgFileName)); err == nil {
+			mtime = fi.ModTime()
+		}
+
+		if modules[imp] == nil {
+			modules[imp] = make(map[string]*proxyVersion)
+		}
+		if prev, ok := modules[imp][version]; ok {
+			VLog("proxy: %s@%s is provided by both %s and %s", imp, version, prev.Hash, hash)
+			if prev.Hash < hash {
+				continue
+			}
+		}
+
+		modules[imp][version] = &proxyVersion{
+			Module:  imp,
+			Version: version,
+			Hash:    hash,
+			Pkg:     &pkg,
+			Dir:     dir,
+			Time:    mtime,
+		}
+	}
+
+	p.lk.Lock()
+	p.modules = modules
+	p.scanned = start
+	p.lk.Unlock()
+	return nil
+}
+
+func (p *modProxy) count() int {
+	p.lk.Lock()
+	defer p.lk.Unlock()
+	return len(p.modules)
+}
+
+// lookup finds the package serving the given module version, rescanning
+// root if it is not known yet.
+func (p *modProxy) lookup(mod, version string) *proxyVersion {
+	var v *proxyVersion
+	p.find(func() bool {
+		v = p.modules[mod][version]
+		return v != nil
+	})
+	return v
+}
+
+// versions returns the versions of mod in order, rescanning root if it is
+// not known yet.
+func (p *modProxy) versions(mod string) []string {
+	var out []string
+	p.find(func() bool {
+		for v := range p.modules[mod] {
+			out = append(out, v)
+		}
+		return len(out) > 0
+	})
+	sort.Strings(out)
+	return out
+}
+
+// find calls found with p.lk held until it reports success, rescanning root
+// once in between unless it was scanned within proxyRescanInterval.
+func (p *modProxy) find(found func() bool) {
+	p.lk.Lock()
+	ok := found()
+	fresh := time.Since(p.scanned) < proxyRescanInterval
+	p.lk.Unlock()
+	if ok || fresh {
+		return
+	}
+
+	if err := p.reindex(); err != nil {
+		Error("proxy: rescanning %s: %s", p.root, err)
+		return
+	}
+
+	p.lk.Lock()
+	found()
+	p.lk.Unlock()
+}
+
+func (p *modProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	i := strings.Index(r.URL.Path, "/@v/")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	mod, err := unescapeModPath(strings.TrimPrefix(r.URL.Path[:i], "/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file := r.URL.Path[i+len("/@v/"):]
+	if file == "list" {
+		// unknown modules are not found rather than listed without
+		// versions, so that the go tool moves on to the next proxy
+		versions := p.versions(mod)
+		if len(versions) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, v := range versions {
+			fmt.Fprintln(w, v)
+		}
+		return
+	}
+
+	ext := path.Ext(file)
+	version, err := unescapeModPath(strings.TrimSuffix(file, ext))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	v := p.lookup(mod, version)
+	if v == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch ext {
+	case ".info":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Version string
+			Time    time.Time
+		}{v.Version, v.Time})
+	case ".mod":
+		data, err := p.goMod(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(data)
+	case ".zip":
+		buf := new(bytes.Buffer)
+		if err := p.writeZip(buf, v); err != nil {
+			Error("proxy: building zip of %s@%s: %s", v.Module, v.Version, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/zip")
+		buf.WriteTo(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// goMod generates the go.mod of a module version from the dependencies of
+// its package. Modules with '+incompatible' versions predate modules, so
+// theirs only names the module.
+func (p *modProxy) goMod(v *proxyVersion) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "module %s\n", v.Module)
+	if v.incompatible() {
+		return buf.Bytes(), nil
+	}
+
+	var reqs []string
+	for _, dep := range v.Pkg.Dependencies {
+		cpkg, err := loadDep(dep, p.root)
+		if err != nil {
+			return nil, fmt.Errorf("dependency %s (%s) of %s: %s", dep.Name, dep.Hash, v.Module, err)
+		}
+
+		imp := cpkg.Dms3Gx.DvcsImport
+		version, ok := proxyModVersion(imp, cpkg.Version)
+		if imp == "" || !ok {
+			VLog("proxy: cannot require %s (%s) from %s", dep.Name, dep.Hash, v.Module)
+			continue
+		}
+		reqs = append(reqs, imp+" "+version)
+	}
+	sort.Strings(reqs)
+
+	if len(reqs) > 0 {
+		fmt.Fprintf(buf, "\nrequire (\n")
+		for _, req := range reqs {
+			fmt.Fprintf(buf, "\t%s\n", req)
+		}
+		fmt.Fprintf(buf, ")\n")
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeZip writes the module zip of v to w, with the imports of its go
+// files rewritten back to dvcs paths.
+func (p *modProxy) writeZip(w io.Writer, v *proxyVersion) error {
+	mapping := make(map[string]string)
+	for _, dep := range v.Pkg.Dependencies {
+		cpkg, err := loadDep(dep, p.root)
+		if err != nil {
+			return err
+		}
+		addRewriteForDep(dep, cpkg, mapping, true, true)
+	}
+	// the package's own imports of itself
+	mapping[dms3gxImport(v.Hash, v.Pkg.Name)] = v.Module
+	rwf := rewriteMapper(mapping)
+
+	gomod, err := p.goMod(v)
+	if err != nil {
+		return err
+	}
+
+	// the package may be linked to a dvcs checkout
+	dir, err := filepath.EvalSymlinks(v.Dir)
+	if err != nil {
+		return err
+	}
+
+	prefix := v.Module + "@" + v.Version + "/"
+	zw := zip.NewWriter(w)
+
+	if !v.incompatible() {
+		f, err := zw.Create(prefix + "go.mod")
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(gomod); err != nil {
+			return err
+		}
+	}
+
+	err = filepath.Walk(dir, func(fpath string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, fpath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if fi.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			switch fi.Name() {
+			case ".git", ".hg", ".svn", ".bzr", "vendor", rw.JournalDir:
+				return filepath.SkipDir
+			}
+			// nested modules are not part of this one
+			if _, err := os.Stat(filepath.Join(fpath, "go.mod")); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !fi.Mode().IsRegular() || rel == "go.mod" {
+			return nil
+		}
+
+		data, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return err
+		}
+
+		if strings.HasSuffix(rel, ".go") {
+			// leave files we cannot parse, such as test data, alone
+			if ndata, err := rw.RewriteSource(fpath, data, rwf); err == nil {
+				data = ndata
+			}
+		}
+
+		f, err := zw.Create(prefix + rel)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+var gxSemver = regexp.MustCompile(`^v?([0-9]+)\.[0-9]+\.[0-9]+(-[0-9A-Za-z.-]+)?$`)
+
+// proxyModVersion returns the module version serving the dms3gx version v
+// of the package with dvcs import path mod. Paths with a '/vN' or gopkg.in
+// '.vN' suffix only serve versions of that major version. Without one,
+// versions from 2 on are marked '+incompatible'.
+func proxyModVersion(mod, v string) (string, bool) {
+	m := gxSemver.FindStringSubmatch(v)
+	if m == nil {
+		return "", false
+	}
+	v = "v" + strings.TrimPrefix(v, "v")
+
+	major, err := strconv.Atoi(m[1])
+	if err != nil {
+		return "", false
+	}
+
+	switch suffix := pathMajor(mod); {
+	case suffix != "":
+		return v, suffix == m[1]
+	case major >= 2:
+		return v + "+incompatible", true
+	default:
+		return v, true
+	}
+}
+
+// unescapeModPath reverses escapeModPath.
+func unescapeModPath(s string) (string, error) {
+	var b strings.Builder
+	bang := false
+	for _, r := range s {
+		switch {
+		case bang:
+			if !unicode.IsLower(r) {
+				return "", fmt.Errorf("invalid escaped path %q", s)
+			}
+			b.WriteRune(unicode.ToUpper(r))
+			bang = false
+		case r == '!':
+			bang = true
+		case unicode.IsUpper(r):
+			return "", fmt.Errorf("invalid escaped path %q", s)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if bang {
+		return "", fmt.Errorf("invalid escaped path %q", s)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+)
+
+// writeInstalledPackage installs a package with the given files under
+// '<root>/<hash>/<name>', the way dms3gx does.
+func writeInstalledPackage(t *testing.T, root, hash string, pkg *Package, files map[string]string) {
+	t.Helper()
+	dir := filepath.Join(root, hash, pkg.Name)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := dms3gx.SavePackageFile(pkg, filepath.Join(dir, dms3gx.PkgFileName)); err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func newTestPackage(name, version, dvcs string, deps ...*dms3gx.Dependency) *Package {
+	pkg := &Package{Dms3Gx: GoInfo{DvcsImport: dvcs}}
+	pkg.Name = name
+	pkg.Version = version
+	pkg.Language = "go"
+	pkg.Dependencies = deps
+	return pkg
+}
+
+func newTestProxy(t *testing.T) *httptest.Server {
+	t.Helper()
+	root := t.TempDir()
+
+	writeInstalledPackage(t, root, "QmLib", newTestPackage("lib", "1.0.0", "github.com/x/lib"), map[string]string{
+		"lib.go": "package lib\n\nconst L = 1\n",
+	})
+	writeInstalledPackage(t, root, "QmYaml", newTestPackage("yaml", "2.2.8", "gopkg.in/yaml.v2"), map[string]string{
+		"yaml.go": "package yaml\n",
+	})
+
+	libdep := &dms3gx.Dependency{Name: "lib", Hash: "QmLib", Version: "1.0.0"}
+	yamldep := &dms3gx.Dependency{Name: "yaml", Hash: "QmYaml", Version: "2.2.8"}
+	writeInstalledPackage(t, root, "QmApp", newTestPackage("app", "0.3.0", "github.com/x/app", libdep, yamldep), map[string]string{
+		"app.go": "package app\n\nimport (\n\t\"" + dms3gxImport("QmLib", "lib") + "\"\n\t_ \"" +
+			dms3gxImport("QmYaml", "yaml") + "\"\n)\n\nvar _ = lib.L\n",
+		"testdata/bad.go": "package bad\n\nimport (\n",
+		"vendor/v.go":     "package v\n",
+	})
+
+	p, err := newModProxy(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func proxyGet(t *testing.T, srv *httptest.Server, path string) (int, []byte) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestProxyList(t *testing.T) {
+	srv := newTestProxy(t)
+
+	for mod, want := range map[string]string{
+		"github.com/x/lib": "v1.0.0\n",
+		"github.com/x/app": "v0.3.0\n",
+		"gopkg.in/yaml.v2": "v2.2.8\n",
+	} {
+		code, body := proxyGet(t, srv, "/"+mod+"/@v/list")
+		if code != http.StatusOK {
+			t.Errorf("%s: got status %d", mod, code)
+		}
+		if string(body) != want {
+			t.Errorf("%s: got versions %q, want %q", mod, body, want)
+		}
+	}
+}
+
+func TestProxyInfo(t *testing.T) {
+	srv := newTestProxy(t)
+
+	code, body := proxyGet(t, srv, "/github.com/x/lib/@v/v1.0.0.info")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+
+	var info struct {
+		Version string
+	}
+	if err := json.Unmarshal(body, &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Version != "v1.0.0" {
+		t.Errorf("got version %q", info.Version)
+	}
+}
+
+func TestProxyMod(t *testing.T) {
+	srv := newTestProxy(t)
+
+	code, body := proxyGet(t, srv, "/github.com/x/app/@v/v0.3.0.mod")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+
+	want := "module github.com/x/app\n\nrequire (\n\tgithub.com/x/lib v1.0.0\n\tgopkg.in/yaml.v2 v2.2.8\n)\n"
+	if string(body) != want {
+		t.Errorf("got go.mod:\n%s\nwant:\n%s", body, want)
+	}
+}
+
+func TestProxyZip(t *testing.T) {
+	srv := newTestProxy(t)
+
+	code, body := proxyGet(t, srv, "/github.com/x/app/@v/v0.3.0.zip")
+	if code != http.StatusOK {
+		t.Fatalf("got status %d", code)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = string(data)
+	}
+
+	prefix := "github.com/x/app@v0.3.0/"
+	for _, name := range []string{"go.mod", "app.go", dms3gx.PkgFileName, "testdata/bad.go"} {
+		if _, ok := files[prefix+name]; !ok {
+			t.Errorf("zip is missing %s", name)
+		}
+	}
+	if _, ok := files[prefix+"vendor/v.go"]; ok {
+		t.Error("zip includes the vendor directory")
+	}
+
+	app := files[prefix+"app.go"]
+	if !strings.Contains(app, `"github.com/x/lib"`) || !strings.Contains(app, `"gopkg.in/yaml.v2"`) {
+		t.Errorf("imports of app.go were not rewritten to dvcs paths:\n%s", app)
+	}
+}
+
+func TestProxyUnknown(t *testing.T) {
+	srv := newTestProxy(t)
+
+	for _, path := range []string{
+		"/github.com/x/nope/@v/list",
+		"/github.com/x/nope/@v/v1.0.0.info",
+		"/github.com/x/lib/@v/v9.0.0.info",
+		"/github.com/x/lib/@v/v9.0.0.mod",
+		"/github.com/x/lib/@v/v9.0.0.zip",
+	} {
+		if code, _ := proxyGet(t, srv, path); code != http.StatusNotFound {
+			t.Errorf("%s: got status %d, want %d", path, code, http.StatusNotFound)
+		}
+	}
+}
+
+func TestProxyModVersion(t *testing.T) {
+	for _, tc := range []struct {
+		mod, v, want string
+		ok           bool
+	}{
+		{"github.com/x/y", "1.2.3", "v1.2.3", true},
+		{"github.com/x/y", "2.0.0", "v2.0.0+incompatible", true},
+		{"github.com/x/y/v2", "2.1.0", "v2.1.0", true},
+		{"github.com/x/y/v2", "3.0.0", "v3.0.0", false},
+		{"gopkg.in/yaml.v2", "2.2.8", "v2.2.8", true},
+		{"gopkg.in/yaml.v2", "1.0.0", "v1.0.0", false},
+		{"github.com/x/y", "latest", "", false},
+	} {
+		got, ok := proxyModVersion(tc.mod, tc.v)
+		if ok != tc.ok || (ok && got != tc.want) {
+			t.Errorf("proxyModVersion(%q, %q) = %q, %v, want %q, %v", tc.mod, tc.v, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// number of unchanged lines shown around each change
+const diffContext = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line []byte
+}
+
+// unifiedDiff writes a unified diff between a and b to w, labeling the two
+// sides with from and to. Nothing is written if a and b are equal.
+func unifiedDiff(w io.Writer, from, to string, a, b []byte) error {
+	if bytes.Equal(a, b) {
+		return nil
+	}
+
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "--- %s\n+++ %s\n", from, to)
+
+	// oline and nline track the (zero based) line numbers in the old and
+	// new file of ops[i]
+	var oline, nline int
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			oline++
+			nline++
+			i++
+			continue
+		}
+
+		// found a change, back up to include the leading context
+		start := i
+		for start > 0 && i-start < diffContext && ops[start-1].kind == ' ' {
+			start--
+		}
+		ostart := oline - (i - start)
+		nstart := nline - (i - start)
+
+		// extend the hunk until we see more than twice the context worth
+		// of unchanged lines, so that nearby changes share a hunk
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContext {
+				end += min(run-end, diffContext)
+				break
+			}
+			end = run
+		}
+
+		var ocount, ncount int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				ocount++
+			}
+			if op.kind != '-' {
+				ncount++
+			}
+		}
+
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n", hunkRange(ostart, ocount), hunkRange(nstart, ncount))
+		for _, op := range ops[start:end] {
+			buf.WriteByte(op.kind)
+			buf.Write(op.line)
+			if !bytes.HasSuffix(op.line, []byte("\n")) {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		oline = ostart + ocount
+		nline = nstart + ncount
+		i = end
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		// an empty range refers to the line before it
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// splitLines splits b after every newline, keeping the newlines.
+func splitLines(b []byte) [][]byte {
+	var lines [][]byte
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			lines = append(lines, b)
+			break
+		}
+		lines = append(lines, b[:i+1])
+		b = b[i+1:]
+	}
+	return lines
+}
+
+// diffLines computes a line based edit script turning a into b. Import
+// rewrites only ever touch a small region of a file, so the common prefix
+// and suffix are stripped before running a simple LCS over the remainder.
+func diffLines(a, b [][]byte) []diffOp {
+	var pre int
+	for pre < len(a) && pre < len(b) && bytes.Equal(a[pre], b[pre]) {
+		pre++
+	}
+
+	var suf int
+	for suf < len(a)-pre && suf < len(b)-pre && bytes.Equal(a[len(a)-1-suf], b[len(b)-1-suf]) {
+		suf++
+	}
+
+	var ops []diffOp
+	for _, l := range a[:pre] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	ma := a[pre : len(a)-suf]
+	mb := b[pre : len(b)-suf]
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// ma[i:] and mb[j:]
+	lcs := make([][]int, len(ma)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(mb)+1)
+	}
+	for i := len(ma) - 1; i >= 0; i-- {
+		for j := len(mb) - 1; j >= 0; j-- {
+			if bytes.Equal(ma[i], mb[j]) {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var i, j int
+	for i < len(ma) && j < len(mb) {
+		switch {
+		case bytes.Equal(ma[i], mb[j]):
+			ops = append(ops, diffOp{' ', ma[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', ma[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', mb[j]})
+			j++
+		}
+	}
+	for ; i < len(ma); i++ {
+		ops = append(ops, diffOp{'-', ma[i]})
+	}
+	for ; j < len(mb); j++ {
+		ops = append(ops, diffOp{'+', mb[j]})
+	}
+
+	for _, l := range a[len(a)-suf:] {
+		ops = append(ops, diffOp{' ', l})
+	}
+
+	return ops
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,311 @@
+package rewrite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	fs "github.com/kr/fs"
+)
+
+// JournalDir is the directory, relative to the root of a rewrite, that holds
+// backups of the files being rewritten along with the journal describing
+// them. It only exists while a rewrite is in progress, or after one was
+// interrupted.
+const JournalDir = ".dms3gx-go-rewrite"
+
+// name of the journal within JournalDir. Its presence marks the point at
+// which a rewrite starts modifying files.
+const journalFile = "journal.json"
+
+// suffix of the files holding the rewritten contents before they are
+// moved into place
+const stagedSuffix = ".temp"
+
+type journalEntry struct {
+	// Path of the rewritten file, relative to the root
+	Path string `json:"path"`
+
+	// Backup of the original contents, relative to JournalDir
+	Backup string `json:"backup"`
+
+	// Mode of the original file
+	Mode os.FileMode `json:"mode"`
+}
+
+// journal tracks a set of staged file rewrites so that they can be applied
+// as a unit, and rolled back or finished if that gets interrupted.
+type journal struct {
+	root string
+	dir  string
+
+	lk    sync.Mutex
+	Files []journalEntry `json:"files"`
+}
+
+func openJournal(root string) (*journal, error) {
+	dir := filepath.Join(root, JournalDir)
+	err := os.Mkdir(dir, 0755)
+	if os.IsExist(err) {
+		return nil, fmt.Errorf("an earlier rewrite of %s was interrupted, run %s first", root, recoverCommand(root, false))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &journal{root: root, dir: dir}, nil
+}
+
+// recoverCommand returns the command recovering from an interrupted rewrite
+// of root, which is not necessarily the package root of the working
+// directory.
+func recoverCommand(root string, rollback bool) string {
+	cmd := "dms3gx-go rewrite --recover"
+	if rollback {
+		cmd += " --rollback"
+	}
+	return fmt.Sprintf("'%s %s'", cmd, root)
+}
+
+func loadJournal(root string) (*journal, error) {
+	j := &journal{root: root, dir: filepath.Join(root, JournalDir)}
+
+	data, err := ioutil.ReadFile(filepath.Join(j.dir, journalFile))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, j); err != nil {
+		return nil, fmt.Errorf("reading rewrite journal: %s", err)
+	}
+
+	return j, nil
+}
+
+func (j *journal) path(e journalEntry) string {
+	return filepath.Join(j.root, e.Path)
+}
+
+// stage writes the rewritten contents of the file at rel next to it, with
+// the mode and owner of the original described by fi, and saves a backup of
+// its original contents.
+func (j *journal) stage(rel string, fi os.FileInfo, orig, nsrc []byte) error {
+	j.lk.Lock()
+	e := journalEntry{
+		Path:   rel,
+		Backup: fmt.Sprintf("%d.orig", len(j.Files)),
+		Mode:   fi.Mode() & modeBits,
+	}
+	j.Files = append(j.Files, e)
+	j.lk.Unlock()
+
+	if err := ioutil.WriteFile(filepath.Join(j.dir, e.Backup), orig, 0644); err != nil {
+		return err
+	}
+
+	staged := j.path(e) + stagedSuffix
+	return writeFileMode(staged, nsrc, e.Mode, fi)
+}
+
+// commit moves every staged file into place. If that fails part way, the
+// files already moved are restored from their backups.
+func (j *journal) commit() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write the journal under a temporary name first, so that a journal
+	// is either complete or absent
+	jpath := filepath.Join(j.dir, journalFile)
+	if err := ioutil.WriteFile(jpath+stagedSuffix, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(jpath+stagedSuffix, jpath); err != nil {
+		return err
+	}
+
+	for n, e := range j.Files {
+		err := os.Rename(j.path(e)+stagedSuffix, j.path(e))
+		if err == nil {
+			continue
+		}
+
+		if rerr := j.restore(j.Files[:n]); rerr != nil {
+			return fmt.Errorf("%s (rollback failed: %s, run %s)", err, rerr, recoverCommand(j.root, true))
+		}
+		j.abort()
+		return err
+	}
+
+	return os.RemoveAll(j.dir)
+}
+
+// abort drops all staged files along with the journal. The original files
+// are left untouched.
+func (j *journal) abort() {
+	for _, e := range j.Files {
+		os.Remove(j.path(e) + stagedSuffix)
+	}
+	os.RemoveAll(j.dir)
+}
+
+// restore moves the backups of the given entries over their files. They are
+// staged first, as the files may be read only.
+func (j *journal) restore(entries []journalEntry) error {
+	for _, e := range entries {
+		orig, err := ioutil.ReadFile(filepath.Join(j.dir, e.Backup))
+		if err != nil {
+			return err
+		}
+
+		staged := j.path(e) + stagedSuffix
+		owner, _ := os.Stat(j.path(e))
+		if err := writeFileMode(staged, orig, e.Mode, owner); err != nil {
+			return err
+		}
+
+		if err := os.Rename(staged, j.path(e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// modeBits are the bits of a file's mode kept across rewrites
+const modeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// writeFileMode writes data to the file at path, which is replaced if it
+// exists, gives it the owner described by owner unless that is nil, and
+// sets its mode bits to exactly mode. Journals written before modes were
+// recorded have a zero mode, for which 0644 is used.
+func writeFileMode(path string, data []byte, mode os.FileMode, owner os.FileInfo) error {
+	if mode == 0 {
+		mode = 0644
+	}
+
+	os.Remove(path)
+	if err := ioutil.WriteFile(path, data, mode); err != nil {
+		return err
+	}
+
+	// before setting the mode, as changing the owner clears the setuid
+	// and setgid bits
+	if owner != nil {
+		chownLike(path, owner)
+	}
+
+	// not subject to the umask, unlike the mode the file is created with
+	return os.Chmod(path, mode)
+}
+
+// finish moves the staged files that are still pending into place.
+func (j *journal) finish() error {
+	for _, e := range j.Files {
+		err := os.Rename(j.path(e)+stagedSuffix, j.path(e))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Recover cleans up after a rewrite of ipath that was interrupted. If the
+// rewrite had started modifying files it is finished, or undone if rollback
+// is set. Leftover staged files are removed in any case. It returns the
+// number of files that were finished or restored.
+func Recover(ipath string, rollback bool) (int, error) {
+	root, err := filepath.EvalSymlinks(ipath)
+	if err != nil {
+		return 0, err
+	}
+
+	j, err := loadJournal(root)
+	switch {
+	case os.IsNotExist(err):
+		// the rewrite never got as far as touching any files
+		if err := removeStaged(root); err != nil {
+			return 0, err
+		}
+		return 0, os.RemoveAll(filepath.Join(root, JournalDir))
+	case err != nil:
+		return 0, err
+	}
+
+	if rollback {
+		err = j.restore(j.Files)
+	} else {
+		err = j.finish()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	j.abort()
+	return len(j.Files), nil
+}
+
+// Leftovers returns the files an interrupted rewrite of ipath left behind:
+// staged go files and the journal directory, relative to ipath. Recover
+// cleans them up.
+func Leftovers(ipath string) ([]string, error) {
+	root, err := filepath.EvalSymlinks(ipath)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	if _, err := os.Stat(filepath.Join(root, JournalDir)); err == nil {
+		out = append(out, JournalDir)
+	}
+
+	staged, err := stagedFiles(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range staged {
+		out = append(out, f[len(root)+1:])
+	}
+	return out, nil
+}
+
+// removeStaged removes every staged go file under root.
+func removeStaged(root string) error {
+	staged, err := stagedFiles(root)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range staged {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stagedFiles returns the paths of the staged go files under root.
+func stagedFiles(root string) ([]string, error) {
+	var out []string
+	w := fs.Walk(root)
+	for w.Step() {
+		if w.Err() != nil {
+			continue
+		}
+
+		rel := strings.TrimPrefix(w.Path()[len(root):], string(filepath.Separator))
+		if strings.HasPrefix(rel, ".git") || strings.HasPrefix(rel, "vendor") {
+			w.SkipDir()
+			continue
+		}
+
+		if strings.HasSuffix(rel, ".go"+stagedSuffix) {
+			out = append(out, w.Path())
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,288 @@
+package rewrite
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const (
+	oldSrc = "package a\n\nimport \"old/x\"\n\nvar _ = x.X\n"
+	newSrc = "package a\n\nimport \"new/x\"\n\nvar _ = x.X\n"
+	badSrc = "package a\n\nimport (\n"
+)
+
+func oldToNew(imp string) string {
+	return strings.Replace(imp, "old/", "new/", 1)
+}
+
+func goFiles(rel string) bool {
+	return strings.HasSuffix(rel, ".go")
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, src := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, want := range files {
+		got, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s:\ngot:\n%s\nwant:\n%s", name, got, want)
+		}
+	}
+}
+
+func checkNoLeftovers(t *testing.T, root string) {
+	t.Helper()
+	left, err := Leftovers(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("leftovers: %v", left)
+	}
+}
+
+func TestRewriteImportsAbort(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.go":     oldSrc,
+		"sub/b.go": oldSrc,
+		"sub/c.go": badSrc,
+	})
+
+	res, err := RewriteImports(root, oldToNew, goFiles, Options{})
+	if err == nil {
+		t.Fatal("expected the unparsable file to fail the rewrite")
+	}
+	if len(res.Errors) != 1 || filepath.Base(res.Errors[0].Path) != "c.go" {
+		t.Fatalf("expected one error for c.go, got %v", res.Errors)
+	}
+	if res.Changed != 0 {
+		t.Errorf("expected no files changed, got %d", res.Changed)
+	}
+
+	checkTree(t, root, map[string]string{
+		"a.go":     oldSrc,
+		"sub/b.go": oldSrc,
+		"sub/c.go": badSrc,
+	})
+	checkNoLeftovers(t, root)
+}
+
+func TestRewriteImportsSkipErrors(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.go":     oldSrc,
+		"sub/b.go": oldSrc,
+		"sub/c.go": badSrc,
+	})
+
+	res, err := RewriteImports(root, oldToNew, goFiles, Options{SkipErrors: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Skipped) != 1 || filepath.Base(res.Skipped[0].Path) != "c.go" {
+		t.Fatalf("expected c.go to be skipped, got %v", res.Skipped)
+	}
+	if res.Changed != 2 {
+		t.Errorf("expected 2 files changed, got %d", res.Changed)
+	}
+
+	checkTree(t, root, map[string]string{
+		"a.go":     newSrc,
+		"sub/b.go": newSrc,
+		"sub/c.go": badSrc,
+	})
+	checkNoLeftovers(t, root)
+}
+
+func TestRewriteImportsSkipsTestdata(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"a.go":                oldSrc,
+		"testdata/bad.go":     badSrc,
+		"sub/testdata/old.go": oldSrc,
+	})
+
+	res, err := RewriteImports(root, oldToNew, goFiles, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Scanned != 1 {
+		t.Errorf("expected only a.go to be scanned, got %d files", res.Scanned)
+	}
+
+	checkTree(t, root, map[string]string{
+		"a.go":                newSrc,
+		"testdata/bad.go":     badSrc,
+		"sub/testdata/old.go": oldSrc,
+	})
+}
+
+func TestRewriteImportsKeepsModeBits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no setuid and setgid bits on windows")
+	}
+
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.go": oldSrc, "b.go": oldSrc})
+
+	mode := os.ModeSetuid | os.ModeSetgid | 0750
+	if err := os.Chmod(filepath.Join(root, "a.go"), mode); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(root, "a.go")); err != nil || fi.Mode()&modeBits != mode {
+		t.Skip("cannot set the setuid and setgid bits here")
+	}
+
+	// the rollback restores modes as well
+	interruptRewrite(t, root, []string{"a.go", "b.go"}, true, 1)
+	if _, err := Recover(root, true); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, root, map[string]string{"a.go": oldSrc})
+
+	if _, err := RewriteImports(root, oldToNew, goFiles, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, root, map[string]string{"a.go": newSrc})
+
+	fi, err := os.Stat(filepath.Join(root, "a.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&modeBits != mode {
+		t.Errorf("got mode %s, want %s", fi.Mode(), mode)
+	}
+}
+
+// interruptRewrite leaves root the way a rewrite of files interrupted after
+// moving the first moved of them into place would. If journaled is unset,
+// the rewrite is interrupted before it wrote its journal.
+func interruptRewrite(t *testing.T, root string, files []string, journaled bool, moved int) {
+	t.Helper()
+	j, err := openJournal(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		p := filepath.Join(root, f)
+		fi, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := j.stage(f, fi, src, []byte(oldToNewSrc(string(src)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !journaled {
+		return
+	}
+
+	data, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(j.dir, journalFile), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range j.Files[:moved] {
+		if err := os.Rename(j.path(e)+stagedSuffix, j.path(e)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func oldToNewSrc(src string) string {
+	return strings.Replace(src, `"old/`, `"new/`, -1)
+}
+
+func TestRecover(t *testing.T) {
+	files := []string{"a.go", "b.go", "c.go"}
+	orig := map[string]string{"a.go": oldSrc, "b.go": oldSrc, "c.go": oldSrc}
+	rewritten := map[string]string{"a.go": newSrc, "b.go": newSrc, "c.go": newSrc}
+
+	for _, tc := range []struct {
+		name      string
+		journaled bool
+		rollback  bool
+		n         int
+		want      map[string]string
+	}{
+		{"unjournaled", false, false, 0, orig},
+		{"finish", true, false, 3, rewritten},
+		{"rollback", true, true, 3, orig},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeTree(t, root, orig)
+			interruptRewrite(t, root, files, tc.journaled, 1)
+
+			_, err := RewriteImports(root, oldToNew, goFiles, Options{})
+			if err == nil {
+				t.Error("expected a rewrite to refuse to start before recovering")
+			} else if !strings.Contains(err.Error(), "'dms3gx-go rewrite --recover "+root+"'") {
+				t.Errorf("expected the error to say how to recover %s, got: %s", root, err)
+			}
+
+			left, err := Leftovers(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) == 0 {
+				t.Error("expected the interrupted rewrite to leave files behind")
+			}
+
+			n, err := Recover(root, tc.rollback)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tc.n {
+				t.Errorf("expected %d files recovered, got %d", tc.n, n)
+			}
+
+			checkTree(t, root, tc.want)
+			checkNoLeftovers(t, root)
+		})
+	}
+}
+
+func TestRecoverNothing(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{"a.go": oldSrc})
+
+	n, err := Recover(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("expected nothing to recover, got %d files", n)
+	}
+	checkTree(t, root, map[string]string{"a.go": oldSrc})
+}
@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package rewrite
+
+import "os"
+
+// chownLike is a no-op on systems without unix file ownership.
+func chownLike(path string, fi os.FileInfo) {}
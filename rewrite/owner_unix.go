@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package rewrite
+
+import (
+	"os"
+	"syscall"
+)
+
+// chownLike gives the file at path the owner and group described by fi.
+// This is best effort: only the superuser may hand files to other users.
+func chownLike(path string, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		os.Lchown(path, int(st.Uid), int(st.Gid))
+	}
+}
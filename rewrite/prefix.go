@@ -0,0 +1,83 @@
+package rewrite
+
+import "strings"
+
+// PrefixMap maps import paths to new ones by prefix. An entry for
+// 'github.com/a/b' applies to that path and every path below it, such as
+// 'github.com/a/b/c', but not to 'github.com/a/bc'. When several entries
+// match a path, the longest one wins, so lookups do not depend on the order
+// in which entries were added.
+//
+// A PrefixMap is safe for concurrent lookups once all entries are added.
+type PrefixMap struct {
+	root prefixNode
+}
+
+type prefixNode struct {
+	children map[string]*prefixNode
+
+	// set if an entry ends at this node
+	to  string
+	set bool
+}
+
+// NewPrefixMap returns a PrefixMap holding every entry of m.
+func NewPrefixMap(m map[string]string) *PrefixMap {
+	pm := new(PrefixMap)
+	for from, to := range m {
+		pm.Add(from, to)
+	}
+	return pm
+}
+
+// Add maps from, and every path below it, to to. It replaces any existing
+// entry for from.
+func (pm *PrefixMap) Add(from, to string) {
+	n := &pm.root
+	for _, el := range strings.Split(from, "/") {
+		if n.children == nil {
+			n.children = make(map[string]*prefixNode)
+		}
+		c, ok := n.children[el]
+		if !ok {
+			c = new(prefixNode)
+			n.children[el] = c
+		}
+		n = c
+	}
+	n.to = to
+	n.set = true
+}
+
+// Match returns the longest prefix of path that has an entry, along with
+// what it maps to. ok is false if no entry matches.
+func (pm *PrefixMap) Match(path string) (prefix, to string, ok bool) {
+	n := &pm.root
+	var end int
+	for i, el := range strings.Split(path, "/") {
+		c, found := n.children[el]
+		if !found {
+			break
+		}
+		n = c
+
+		end += len(el)
+		if i > 0 {
+			end++
+		}
+		if n.set {
+			prefix, to, ok = path[:end], n.to, true
+		}
+	}
+	return prefix, to, ok
+}
+
+// Rewrite returns path with its longest matching prefix replaced by what it
+// maps to, or path unchanged if no entry matches.
+func (pm *PrefixMap) Rewrite(path string) string {
+	prefix, to, ok := pm.Match(path)
+	if !ok {
+		return path
+	}
+	return to + path[len(prefix):]
+}
@@ -3,16 +3,20 @@ package rewrite
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/printer"
+	"go/scanner"
 	"go/token"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,38 +32,432 @@ var bufpool = &sync.Pool{
 
 var cfg = &printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
 
-func RewriteImports(ipath string, rw func(string) string, filter func(string) bool) error {
-	path, err := filepath.EvalSymlinks(ipath)
+// Result summarizes a call to RewriteImports.
+type Result struct {
+	// Scanned is the number of files that passed the filter and were
+	// handed to the rewriter.
+	Scanned int
+
+	// Changed is the number of files whose imports were rewritten.
+	Changed int
+
+	// Errors holds one entry for every file that could not be
+	// processed, sorted by path.
+	Errors []*FileError
+
+	// Skipped holds the files left out because they could not be parsed,
+	// with Options.SkipErrors set, sorted by path.
+	Skipped []*FileError
+}
+
+// Err returns nil if every file was processed successfully, and an error
+// listing the failures otherwise.
+func (r *Result) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	return &RewriteError{Errors: r.Errors}
+}
+
+func (r *Result) addError(ferr *FileError) {
+	r.Errors = append(r.Errors, ferr)
+}
+
+// Options adjusts how RewriteImports, DiffImports and OverlayImports treat
+// the files they visit.
+type Options struct {
+	// SkipErrors leaves the files that cannot be parsed out of the
+	// rewrite, recording them in Result.Skipped, instead of failing it.
+	SkipErrors bool
+
+	// Sort reprints the import declarations of rewritten files sorted,
+	// the way gofmt does. By default only the import paths are replaced,
+	// leaving the grouping, order and comments of the imports exactly as
+	// they were.
+	Sort bool
+}
+
+// skippedError marks a failure that leaves a file out of the rewrite without
+// failing it.
+type skippedError struct {
+	err error
+}
+
+func (e skippedError) Error() string {
+	return e.err.Error()
+}
+
+// sourceError returns the error to report for a file whose source could not
+// be rewritten.
+func (o Options) sourceError(err error) error {
+	if o.SkipErrors {
+		return skippedError{err}
+	}
+	return err
+}
+
+// FileError records a failure to rewrite a single file. Pos is only set
+// when the failure can be attributed to a location within the file, such
+// as a syntax error.
+type FileError struct {
+	Path string
+	Pos  token.Position
+	Err  error
+}
+
+func newFileError(path string, err error) *FileError {
+	ferr := &FileError{Path: path, Err: err}
+	switch err := err.(type) {
+	case scanner.ErrorList:
+		if len(err) > 0 {
+			ferr.Pos = err[0].Pos
+			ferr.Err = errors.New(err[0].Msg)
+			if len(err) > 1 {
+				ferr.Err = fmt.Errorf("%s (and %d more errors)", err[0].Msg, len(err)-1)
+			}
+		}
+	case *scanner.Error:
+		ferr.Pos = err.Pos
+		ferr.Err = errors.New(err.Msg)
+	}
+	return ferr
+}
+
+func (e *FileError) Error() string {
+	if e.Pos.IsValid() {
+		return fmt.Sprintf("%s: %s", e.Pos, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+// RewriteError is returned by RewriteImports when one or more files failed
+// to be rewritten.
+type RewriteError struct {
+	Errors []*FileError
+}
+
+func (e *RewriteError) Error() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "failed to rewrite %d file(s):", len(e.Errors))
+	for _, ferr := range e.Errors {
+		fmt.Fprintf(buf, "\n  %s", ferr)
+	}
+	return buf.String()
+}
+
+// RewriteImports rewrites the import paths of every go file under ipath
+// accepted by filter using rw. The changes are applied as a unit: the
+// rewritten files are staged first, and nothing is modified if any file
+// fails, in which case the failures are collected in the returned Result
+// and the returned error is non-nil. Files that do not parse only fail the
+// rewrite if opts.SkipErrors is unset. While the staged files are moved into
+// place a journal is kept under JournalDir, so that an interrupted rewrite
+// can be finished or rolled back with Recover.
+func RewriteImports(ipath string, rw func(string) string, filter func(string) bool, opts Options) (*Result, error) {
+	s, res, err := StageImports(ipath, rw, filter, opts)
 	if err != nil {
-		return err
+		return res, err
+	}
+
+	if err := s.Commit(); err != nil {
+		res.Changed = 0
+		return res, err
 	}
+	return res, nil
+}
+
+// Staged is a rewrite prepared by StageImports. Until it is committed or
+// aborted no other rewrite of the same directory can start.
+type Staged struct {
+	j *journal
+}
+
+// StageImports does the work of RewriteImports up to the point of modifying
+// files, leaving the rewritten files staged next to the originals. This lets
+// several directories be rewritten together, by staging all of them before
+// committing any.
+func StageImports(ipath string, rw func(string) string, filter func(string) bool, opts Options) (*Staged, *Result, error) {
+	root, err := filepath.EvalSymlinks(ipath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	j, err := openJournal(root)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rwLock sync.Mutex
+	res, err := walkImports(root, filter, func(path, rel string) (bool, error) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+
+		nsrc, err := rewriteImportsInSource(path, src, rw, &rwLock, opts.Sort)
+		if err != nil {
+			return false, opts.sourceError(err)
+		}
+		if nsrc == nil {
+			return false, nil
+		}
+
+		if err := j.stage(rel, fi, src, nsrc); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		j.abort()
+		if res != nil {
+			res.Changed = 0
+		}
+		return nil, res, err
+	}
+
+	return &Staged{j: j}, res, nil
+}
+
+// Commit moves the staged files into place.
+func (s *Staged) Commit() error {
+	if err := s.j.commit(); err != nil {
+		return fmt.Errorf("rewrite of %s failed, no files were changed: %s", s.j.root, err)
+	}
+	return nil
+}
+
+// Abort drops the staged files, leaving the originals untouched.
+func (s *Staged) Abort() {
+	s.j.abort()
+}
+
+// DiffImports is like RewriteImports, but instead of modifying any files it
+// writes a unified diff of the changes that would be made to out. Diffs are
+// written in path order, labeled with paths relative to ipath.
+func DiffImports(ipath string, rw func(string) string, filter func(string) bool, opts Options, out io.Writer) (*Result, error) {
+	var rwLock sync.Mutex
+	var diffLock sync.Mutex
+	diffs := make(map[string][]byte)
+
+	res, err := walkImports(ipath, filter, func(path, rel string) (bool, error) {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+
+		nsrc, err := rewriteImportsInSource(path, src, rw, &rwLock, opts.Sort)
+		if err != nil {
+			return false, opts.sourceError(err)
+		}
+		if nsrc == nil {
+			return false, nil
+		}
+
+		buf := new(bytes.Buffer)
+		rel = filepath.ToSlash(rel)
+		if err := unifiedDiff(buf, "a/"+rel, "b/"+rel, src, nsrc); err != nil {
+			return false, err
+		}
+
+		diffLock.Lock()
+		diffs[rel] = buf.Bytes()
+		diffLock.Unlock()
+		return true, nil
+	})
+	if res == nil {
+		return nil, err
+	}
+
+	var names []string
+	for n := range diffs {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		if _, werr := out.Write(diffs[n]); werr != nil {
+			return res, werr
+		}
+	}
+
+	return res, err
+}
+
+// OverlayImports is like RewriteImports, but instead of modifying any files
+// it writes the rewritten ones under dir, mirroring their location under
+// ipath. It returns a map from the path of every rewritten file to the path
+// of its replacement, suitable for the Replace field of the file passed to
+// 'go build -overlay'.
+func OverlayImports(ipath string, rw func(string) string, filter func(string) bool, opts Options, dir string) (*Result, map[string]string, error) {
+	var rwLock sync.Mutex
+	var replaceLock sync.Mutex
+	replace := make(map[string]string)
+
+	res, err := walkImports(ipath, filter, func(path, rel string) (bool, error) {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+
+		nsrc, err := rewriteImportsInSource(path, src, rw, &rwLock, opts.Sort)
+		if err != nil {
+			return false, opts.sourceError(err)
+		}
+		if nsrc == nil {
+			return false, nil
+		}
+
+		out := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+			return false, err
+		}
+		if err := ioutil.WriteFile(out, nsrc, 0644); err != nil {
+			return false, err
+		}
+
+		replaceLock.Lock()
+		replace[path] = out
+		replaceLock.Unlock()
+		return true, nil
+	})
+
+	return res, replace, err
+}
+
+// Import is an import found in a go file.
+type Import struct {
+	Path string
+
+	// File is the path of the importing file, relative to the directory
+	// passed to ListImports
+	File string
+	Pos  token.Position
+}
+
+// ListImports parses every go file under ipath accepted by filter, the same
+// files RewriteImports would rewrite, and returns their imports ordered by
+// file and position. Files that cannot be parsed are recorded in the
+// returned Result, and make the returned error non-nil.
+func ListImports(ipath string, filter func(string) bool) ([]Import, *Result, error) {
+	var impLock sync.Mutex
+	var imports []Import
+
+	res, err := walkImports(ipath, filter, func(path, rel string) (bool, error) {
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, path, nil, parser.ImportsOnly)
+		if err != nil {
+			return false, err
+		}
+
+		var found []Import
+		for _, imp := range file.Imports {
+			p, err := strconv.Unquote(imp.Path.Value)
+			if err != nil {
+				return false, err
+			}
+			found = append(found, Import{
+				Path: p,
+				File: rel,
+				Pos:  fset.Position(imp.Path.Pos()),
+			})
+		}
 
+		impLock.Lock()
+		imports = append(imports, found...)
+		impLock.Unlock()
+		return false, nil
+	})
+
+	sort.Slice(imports, func(i, j int) bool {
+		if imports[i].File != imports[j].File {
+			return imports[i].File < imports[j].File
+		}
+		return imports[i].Pos.Offset < imports[j].Pos.Offset
+	})
+
+	return imports, res, err
+}
+
+// RewriteSource returns the contents of the go file src with its imports
+// rewritten by rw, or src itself if no import changed. name is only used to
+// label positions in errors.
+func RewriteSource(name string, src []byte, rw func(string) string) ([]byte, error) {
 	var rwLock sync.Mutex
+	out, err := rewriteImportsInSource(name, src, rw, &rwLock, false)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return src, nil
+	}
+	return out, nil
+}
+
+// walkImports calls fn concurrently for every go file under ipath accepted
+// by filter, passing both its full path and its path relative to ipath. fn
+// reports whether it changed the file. Like the go tool, testdata
+// directories are not visited.
+func walkImports(ipath string, filter func(string) bool, fn func(path, rel string) (bool, error)) (*Result, error) {
+	path, err := filepath.EvalSymlinks(ipath)
+	if err != nil {
+		return nil, err
+	}
+
+	res := new(Result)
+	var resLock sync.Mutex
+
+	type file struct {
+		path, rel string
+	}
 
 	var wg sync.WaitGroup
-	torewrite := make(chan string)
+	torewrite := make(chan file)
 	for i := 0; i < runtime.NumCPU(); i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for path := range torewrite {
-				err := rewriteImportsInFile(path, rw, &rwLock)
-				if err != nil {
-					fmt.Println("rewrite error: ", err)
+			for f := range torewrite {
+				changed, err := fn(f.path, f.rel)
+
+				resLock.Lock()
+				if serr, ok := err.(skippedError); ok {
+					res.Skipped = append(res.Skipped, newFileError(f.path, serr.err))
+				} else if err != nil {
+					res.addError(newFileError(f.path, err))
+				} else if changed {
+					res.Changed++
 				}
+				resLock.Unlock()
 			}
 		}()
 	}
 
 	w := fs.Walk(path)
 	for w.Step() {
+		if err := w.Err(); err != nil {
+			resLock.Lock()
+			res.addError(newFileError(w.Path(), err))
+			resLock.Unlock()
+			continue
+		}
+
 		rel := w.Path()[len(path):]
 		if len(rel) == 0 {
 			continue
 		}
 		rel = rel[1:]
 
-		if strings.HasPrefix(rel, ".git") || strings.HasPrefix(rel, "vendor") {
+		if strings.HasPrefix(rel, ".git") || strings.HasPrefix(rel, "vendor") || rel == JournalDir {
+			w.SkipDir()
+			continue
+		}
+
+		if w.Stat().IsDir() && filepath.Base(rel) == "testdata" {
 			w.SkipDir()
 			continue
 		}
@@ -71,138 +469,145 @@ func RewriteImports(ipath string, rw func(string) string, filter func(string) bo
 		if !filter(rel) {
 			continue
 		}
-		torewrite <- w.Path()
+		res.Scanned++
+		torewrite <- file{path: w.Path(), rel: rel}
 	}
 	close(torewrite)
 	wg.Wait()
-	return nil
+
+	sort.Slice(res.Errors, func(i, j int) bool {
+		return res.Errors[i].Path < res.Errors[j].Path
+	})
+	sort.Slice(res.Skipped, func(i, j int) bool {
+		return res.Skipped[i].Path < res.Skipped[j].Path
+	})
+
+	return res, res.Err()
 }
 
-// inspired by godeps rewrite, rewrites import paths with dms3gx vendored names
-func rewriteImportsInFile(fi string, rw func(string) string, rwLock *sync.Mutex) error {
-	// 1. Rewrite the imports (if we have any)
+// rewriteImportsInSource returns the contents of src with its imports
+// rewritten by rw, or nil if no import was changed. fi is only used to
+// label positions in errors.
+//
+// The file is parsed once, up to its imports, and the new paths are spliced
+// into src in place of the old path literals. The imports are only parsed
+// again and reprinted if sortImports is set.
+func rewriteImportsInSource(fi string, src []byte, rw func(string) string, rwLock *sync.Mutex, sortImports bool) ([]byte, error) {
 	fset := token.NewFileSet()
-	file, err := parser.ParseFile(fset, fi, nil, parser.ParseComments|parser.ImportsOnly)
+	file, err := parser.ParseFile(fset, fi, src, parser.ImportsOnly)
 	if err != nil {
-		return err
-	}
-	if len(file.Imports) == 0 {
-		return nil
+		return nil, err
 	}
 
-	oldImportsEnd := fset.Position(file.Imports[len(file.Imports)-1].End()).Offset
-
+	var edits []importEdit
 	rwLock.Lock()
-	var changed bool
 	for _, imp := range file.Imports {
 		p, err := strconv.Unquote(imp.Path.Value)
 		if err != nil {
 			rwLock.Unlock()
-			return err
+			return nil, err
 		}
 
-		np := rw(p)
-
-		if np != p {
-			changed = true
-			imp.Path.Value = strconv.Quote(np)
+		if np := rw(p); np != p {
+			edits = append(edits, importEdit{
+				start: fset.Position(imp.Path.Pos()).Offset,
+				end:   fset.Position(imp.Path.End()).Offset,
+				path:  strconv.Quote(np),
+			})
 		}
 	}
 	rwLock.Unlock()
 
-	if !changed {
-		return nil
+	if len(edits) == 0 {
+		return nil, nil
 	}
 
-	buf := bufpool.Get().(*bytes.Buffer)
-	defer func() {
-		bufpool.Put(buf)
-	}()
-
-	// Write them back to a temporary buffer
-
-	buf.Reset()
-	if err = cfg.Fprint(buf, fset, file); err != nil {
-		return err
+	out := spliceImports(src, edits)
+	if !sortImports {
+		return out, nil
 	}
+	return sortImportsInSource(fi, out)
+}
 
-	// 2. Read the imports back in to sort them.
-
-	fset = token.NewFileSet()
-	file, err = parser.ParseFile(fset, fi, buf, parser.ParseComments|parser.ImportsOnly)
+// sortImportsInSource returns src with its import declarations sorted and
+// reprinted the way gofmt does. The rest of the file is left untouched.
+func sortImportsInSource(fi string, src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, fi, src, parser.ParseComments|parser.ImportsOnly)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	oldImportsEnd := fset.Position(file.Imports[len(file.Imports)-1].End()).Offset
+
 	ast.SortImports(fset, file)
 
-	// Write them back to a temporary buffer
+	buf := bufpool.Get().(*bytes.Buffer)
+	defer func() {
+		bufpool.Put(buf)
+	}()
 
 	buf.Reset()
 	if err = cfg.Fprint(buf, fset, file); err != nil {
-		return err
+		return nil, err
 	}
 
-	// 3. Read them back in to find the new end of the imports.
-
+	// Read them back in to find the new end of the imports, and drop
+	// whatever follows.
 	fset = token.NewFileSet()
-	file, err = parser.ParseFile(fset, fi, buf, parser.ParseComments|parser.ImportsOnly)
-	if err != nil {
-		return err
-	}
-
-	newImportsEnd := fset.Position(file.Imports[len(file.Imports)-1].End()).Offset
-
-	// Write them back to the buffer and truncate.
-	buf.Reset()
-	if err = cfg.Fprint(buf, fset, file); err != nil {
-		return err
-	}
-	buf.Truncate(newImportsEnd)
-
-	// Finally, build the file.
-
-	tmppath := fi + ".temp"
-	tmp, err := os.Create(tmppath)
+	file, err = parser.ParseFile(fset, fi, buf.Bytes(), parser.ImportsOnly)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	buf.Truncate(fset.Position(file.Imports[len(file.Imports)-1].End()).Offset)
 
-	// Write the imports
-	_, err = buf.WriteTo(tmp)
-	if err != nil {
-		return err
+	// The printer drops any byte order mark and always ends lines with
+	// '\n', so restore both to match the original header.
+	header := buf.Bytes()
+	if bytes.Contains(src[:oldImportsEnd], crlf) {
+		header = bytes.Replace(header, lf, crlf, -1)
 	}
 
-	// Copy the rest
-	src, err := os.Open(fi)
-	if err != nil {
-		return err
+	// Finally, build the file from the new imports and the rest of
+	// the original source.
+	out := make([]byte, 0, len(bom)+len(header)+len(src)-oldImportsEnd)
+	if bytes.HasPrefix(src, bom) && !bytes.HasPrefix(header, bom) {
+		out = append(out, bom...)
 	}
+	out = append(out, header...)
+	out = append(out, src[oldImportsEnd:]...)
+	return out, nil
+}
 
-	_, err = src.Seek(int64(oldImportsEnd), io.SeekStart)
-	if err != nil {
-		src.Close()
-		return err
-	}
+// importEdit replaces the import path literal at src[start:end]
+type importEdit struct {
+	start, end int
+	path       string
+}
 
-	_, err = io.Copy(tmp, src)
-	if err != nil {
-		src.Close()
-		return err
+// spliceImports applies edits, which must be ordered by offset, to src.
+func spliceImports(src []byte, edits []importEdit) []byte {
+	var grow int
+	for _, e := range edits {
+		grow += len(e.path) - (e.end - e.start)
 	}
 
-	// Ignore any errors, we didn't modify this file.
-	src.Close()
-
-	// Update the file
-	if err = tmp.Close(); err != nil {
-		return err
+	out := make([]byte, 0, len(src)+grow)
+	var last int
+	for _, e := range edits {
+		out = append(out, src[last:e.start]...)
+		out = append(out, e.path...)
+		last = e.end
 	}
-
-	return os.Rename(tmppath, fi)
+	return append(out, src[last:]...)
 }
 
+var (
+	bom  = []byte("\xef\xbb\xbf")
+	crlf = []byte("\r\n")
+	lf   = []byte("\n")
+)
+
 func fixCanonicalImports(buf []byte) (bool, error) {
 	var i int
 	var changed bool
@@ -0,0 +1,296 @@
+package rewrite
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// formatNodeRewrite rewrites the imports of src the way they were before
+// paths were spliced in: the import declarations are reprinted, and sorted,
+// by format.Node, and the rest of the file is copied over.
+func formatNodeRewrite(t testing.TB, src []byte, rw func(string) string) []byte {
+	t.Helper()
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments|parser.ImportsOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldEnd := fset.Position(file.Imports[len(file.Imports)-1].End()).Offset
+
+	for _, imp := range file.Imports {
+		p, err := strconv.Unquote(imp.Path.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		imp.Path.Value = strconv.Quote(rw(p))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := format.Node(buf, fset, file); err != nil {
+		t.Fatal(err)
+	}
+
+	fset = token.NewFileSet()
+	file, err = parser.ParseFile(fset, "", buf.Bytes(), parser.ImportsOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newEnd := fset.Position(file.Imports[len(file.Imports)-1].End()).Offset
+
+	return append(buf.Bytes()[:newEnd], src[oldEnd:]...)
+}
+
+func toCRLF(b []byte) []byte {
+	return bytes.Replace(b, []byte("\n"), []byte("\r\n"), -1)
+}
+
+func rewriteSource(t testing.TB, src []byte, rw func(string) string, sortImports bool) []byte {
+	t.Helper()
+	var rwLock sync.Mutex
+	out, err := rewriteImportsInSource("x.go", src, rw, &rwLock, sortImports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out == nil {
+		return src
+	}
+	return out
+}
+
+// toDms3gx rewrites the imports of github.com/x packages to dms3gx paths,
+// which keeps their order within a group
+func toDms3gx(imp string) string {
+	if strings.HasPrefix(imp, "github.com/x/") {
+		return "dms3gx/dms3fs/QmHash/" + strings.TrimPrefix(imp, "github.com/x/")
+	}
+	return imp
+}
+
+// in gofmt form, with their github.com/x imports sorted among themselves
+var equivalenceCases = map[string]string{
+	"single": `// Package a does things.
+package a
+
+import "github.com/x/lib"
+
+func F() { lib.G() }
+`,
+
+	"grouped": `package a
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/x/lib"
+	"github.com/x/lib/sub"
+)
+
+var _ = fmt.Sprint(os.Args, lib.L, sub.S)
+`,
+
+	"comments": `// Package a does things.
+package a // import "example.com/a"
+
+// standard library
+import (
+	"fmt" // for printing
+
+	// the library
+	lib "github.com/x/lib"
+	/* its subpackage */ _ "github.com/x/lib/sub"
+	. "github.com/x/other"
+)
+
+// the dependencies are all used
+var _ = fmt.Sprint(lib.L, O)
+`,
+
+	"several decls": `package a
+
+import "fmt"
+
+import (
+	"github.com/x/lib" // lib
+	"github.com/x/other"
+)
+
+import _ "github.com/x/sub"
+
+var _ = fmt.Sprint(lib.L, other.O)
+`,
+}
+
+func TestSpliceMatchesFormatNode(t *testing.T) {
+	for name, src := range equivalenceCases {
+		want := formatNodeRewrite(t, []byte(src), toDms3gx)
+		if bytes.Equal(want, []byte(src)) {
+			t.Fatalf("%s: nothing was rewritten", name)
+		}
+
+		for _, sortImports := range []bool{false, true} {
+			got := rewriteSource(t, []byte(src), toDms3gx, sortImports)
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s (sort %v):\ngot:\n%s\nwant:\n%s", name, sortImports, got, want)
+			}
+
+			// CRLF files keep their line endings, which format.Node
+			// cannot do
+			got = rewriteSource(t, toCRLF([]byte(src)), toDms3gx, sortImports)
+			if !bytes.Equal(got, toCRLF(want)) {
+				t.Errorf("%s (sort %v, CRLF):\ngot:\n%q\nwant:\n%q", name, sortImports, got, toCRLF(want))
+			}
+		}
+	}
+}
+
+// reorders the imports it rewrites
+func toFront(imp string) string {
+	if strings.HasPrefix(imp, "github.com/y/") {
+		return "a.example.com/" + strings.TrimPrefix(imp, "github.com/y/")
+	}
+	return imp
+}
+
+func TestSortMatchesFormatNode(t *testing.T) {
+	src := []byte(`package a
+
+import (
+	"fmt"
+
+	// the x library
+	"github.com/x/lib"
+	yl "github.com/y/lib" // renamed
+	"github.com/z/lib"
+)
+
+var _ = fmt.Sprint(lib.L, yl.L)
+`)
+
+	want := formatNodeRewrite(t, src, toFront)
+	if got := rewriteSource(t, src, toFront, true); !bytes.Equal(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if got := rewriteSource(t, toCRLF(src), toFront, true); !bytes.Equal(got, toCRLF(want)) {
+		t.Errorf("CRLF:\ngot:\n%q\nwant:\n%q", got, toCRLF(want))
+	}
+
+	// without sorting, the renamed import stays where it was
+	spliced := rewriteSource(t, src, toFront, false)
+	if !bytes.Equal(spliced, bytes.Replace(src, []byte(`"github.com/y/lib"`), []byte(`"a.example.com/lib"`), 1)) {
+		t.Errorf("spliced:\n%s", spliced)
+	}
+}
+
+// number of files in the tree rewritten by BenchmarkRewriteImports
+const benchFiles = 300
+
+// writeBenchTree writes a package tree of benchFiles files with a dozen
+// imports each, half of them rewritten by toDms3gx, followed by a body of
+// some length.
+func writeBenchTree(b *testing.B) string {
+	b.Helper()
+	root := b.TempDir()
+
+	body := new(bytes.Buffer)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(body, "\n// F%d returns its argument.\nfunc F%d(x int) int {\n\treturn x + %d\n}\n", i, i, i)
+	}
+
+	for i := 0; i < benchFiles; i++ {
+		src := new(bytes.Buffer)
+		fmt.Fprintf(src, "// Package p%d is generated.\npackage p%d\n\nimport (\n", i/10, i/10)
+		for _, std := range []string{"bytes", "fmt", "io", "os", "strings", "sync"} {
+			fmt.Fprintf(src, "\t%q\n", std)
+		}
+		src.WriteString("\n")
+		for j := 0; j < 6; j++ {
+			fmt.Fprintf(src, "\t_ \"github.com/x/lib%d/sub\" // dependency %d\n", j, j)
+		}
+		src.WriteString(")\n")
+		src.Write(body.Bytes())
+
+		p := filepath.Join(root, fmt.Sprintf("p%d", i/10), fmt.Sprintf("f%d.go", i))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, src.Bytes(), 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return root
+}
+
+func fromDms3gx(imp string) string {
+	if strings.HasPrefix(imp, "dms3gx/dms3fs/QmHash/") {
+		return "github.com/x/" + strings.TrimPrefix(imp, "dms3gx/dms3fs/QmHash/")
+	}
+	return imp
+}
+
+// BenchmarkRewriteImports rewrites the imports of a generated tree back and
+// forth, by splicing paths in place and by reprinting sorted imports.
+func BenchmarkRewriteImports(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		opts Options
+	}{
+		{"splice", Options{}},
+		{"sort", Options{Sort: true}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			root := writeBenchTree(b)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				rw := toDms3gx
+				if i%2 == 1 {
+					rw = fromDms3gx
+				}
+
+				res, err := RewriteImports(root, rw, goFiles, bc.opts)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if res.Changed != benchFiles {
+					b.Fatalf("rewrote %d files, expected %d", res.Changed, benchFiles)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkRewriteSource compares rewriting a single file in memory with the
+// reprinting done before paths were spliced in.
+func BenchmarkRewriteSource(b *testing.B) {
+	src, err := ioutil.ReadFile(filepath.Join(writeBenchTree(b), "p0", "f0.go"))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("splice", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rewriteSource(b, src, toDms3gx, false)
+		}
+	})
+	b.Run("sort", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			rewriteSource(b, src, toDms3gx, true)
+		}
+	})
+	b.Run("format.Node", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			formatNodeRewrite(b, src, toDms3gx)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	cli "github.com/codegangsta/cli"
+	rw "github.com/dms3-why/dms3gx-go/rewrite"
+)
+
+var StatusCommand = cli.Command{
+	Name:  "status",
+	Usage: "show the rewrite state of the current package",
+	Description: `scans the imports of the current package and reports whether it is
+rewritten to dms3gx paths, undone to dvcs paths, or a mix of both. For every
+dependency it shows how many files import it each way, and it lists files
+importing hashes not declared in package.json, packages linked with
+'dms3gx-go link' and files left behind by an interrupted rewrite.`,
+	Action: func(c *cli.Context) error {
+		g, err := loadRootDepGraph()
+		if err != nil {
+			return err
+		}
+
+		st, err := g.rewriteStatus()
+		if err != nil {
+			return err
+		}
+
+		st.write(os.Stdout)
+		return nil
+	},
+}
+
+// depUsage counts the files importing a dependency in each form
+type depUsage struct {
+	Dep          *depNode
+	Hashed, Dvcs int
+}
+
+type rewriteStatus struct {
+	State string
+	Deps  []*depUsage
+
+	// imports of dms3gx packages the root does not depend on directly
+	Undeclared []rw.Import
+
+	Links     [][]string
+	Leftovers []string
+}
+
+// rewriteStatus scans the root package to determine its rewrite state.
+func (g *depGraph) rewriteStatus() (*rewriteStatus, error) {
+	imps, err := g.depImports()
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[*depNode]*depUsage)
+	seen := make(map[string]bool)
+	var hashed, dvcs int
+	for _, imp := range imps {
+		u, ok := usage[imp.Dep]
+		if !ok {
+			u = &depUsage{Dep: imp.Dep}
+			usage[imp.Dep] = u
+		}
+
+		// count files, not imports
+		key := fmt.Sprintf("%s %s %t", imp.Dep.Hash, imp.File, imp.Hashed)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if imp.Hashed {
+			u.Hashed++
+			hashed++
+		} else {
+			u.Dvcs++
+			dvcs++
+		}
+	}
+
+	st := new(rewriteStatus)
+	switch {
+	case hashed > 0 && dvcs > 0:
+		st.State = "mixed"
+	case hashed > 0:
+		st.State = "rewritten"
+	case dvcs > 0:
+		st.State = "undone"
+	default:
+		st.State = "no imports of dependencies"
+	}
+
+	for _, n := range g.sortedNodes() {
+		if u, ok := usage[n]; ok {
+			st.Deps = append(st.Deps, u)
+		}
+	}
+
+	declared := make(map[string]bool)
+	for _, h := range g.Root.Deps {
+		declared[h] = true
+	}
+
+	all, _, err := rw.ListImports(g.Root.Dir, goFileFilter)
+	if err != nil {
+		return nil, err
+	}
+	for _, imp := range all {
+		if !isDms3gxImport(imp.Path) {
+			continue
+		}
+		hash := strings.SplitN(strings.TrimPrefix(imp.Path, namespace+"/"), "/", 2)[0]
+		if !declared[hash] {
+			st.Undeclared = append(st.Undeclared, imp)
+		}
+	}
+
+	st.Links, err = listLinkedPackages()
+	if err != nil {
+		return nil, err
+	}
+
+	st.Leftovers, err = rw.Leftovers(g.Root.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+func (st *rewriteStatus) write(w io.Writer) {
+	fmt.Fprintf(w, "state: %s\n", st.State)
+
+	if len(st.Deps) > 0 {
+		fmt.Fprintf(w, "\ndependencies (files importing by hash / by dvcs path):\n")
+		for _, u := range st.Deps {
+			fmt.Fprintf(w, "  %s: %d / %d\n", u.Dep, u.Hashed, u.Dvcs)
+		}
+	}
+
+	if len(st.Undeclared) > 0 {
+		fmt.Fprintf(w, "\nhashes not declared in package.json:\n")
+		for _, imp := range st.Undeclared {
+			fmt.Fprintf(w, "  %s:%d: %s\n", imp.File, imp.Pos.Line, imp.Path)
+		}
+	}
+
+	if len(st.Links) > 0 {
+		fmt.Fprintf(w, "\nlinked packages:\n")
+		for _, l := range st.Links {
+			fmt.Fprintf(w, "  %s %s\n", l[0], l[1])
+		}
+	}
+
+	if len(st.Leftovers) > 0 {
+		fmt.Fprintf(w, "\nleft behind by an interrupted rewrite, run 'dms3gx-go rewrite --recover':\n")
+		for _, f := range st.Leftovers {
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	cli "github.com/codegangsta/cli"
+	rw "github.com/dms3-why/dms3gx-go/rewrite"
+	dms3gx "github.com/dms3-why/dms3gx/gxutil"
+	. "github.com/whyrusleeping/stump"
+)
+
+var UnusedCommand = cli.Command{
+	Name:  "unused",
+	Usage: "list dependencies no source file imports",
+	Description: `scans every go file of the current package, test files and files
+excluded by build constraints included, and lists the dependencies in
+package.json that are imported neither by their dms3gx nor by their dvcs
+import path. Exits with an error if any are found, unless --prune is given,
+in which case they are removed from package.json.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "prune",
+			Usage: "remove unused dependencies from package.json",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		root, err := dms3gx.GetPackageRoot()
+		if err != nil {
+			return err
+		}
+
+		pkgfile := filepath.Join(root, dms3gx.PkgFileName)
+		pkg, err := LoadPackageFile(pkgfile)
+		if err != nil {
+			return err
+		}
+
+		unused, err := unusedDeps(pkg, root)
+		if err != nil {
+			return err
+		}
+
+		if len(unused) == 0 {
+			Log("all dependencies are in use")
+			return nil
+		}
+
+		for _, dep := range unused {
+			fmt.Printf("%s %s\n", dep.Hash, dep.Name)
+		}
+
+		if !c.Bool("prune") {
+			return fmt.Errorf("found %d unused dependencies", len(unused))
+		}
+
+		remove := make(map[*dms3gx.Dependency]bool)
+		for _, dep := range unused {
+			remove[dep] = true
+		}
+
+		var keep []*dms3gx.Dependency
+		for _, dep := range pkg.Dependencies {
+			if !remove[dep] {
+				keep = append(keep, dep)
+			}
+		}
+		pkg.Dependencies = keep
+
+		if err := dms3gx.SavePackageFile(pkg, pkgfile); err != nil {
+			return err
+		}
+
+		Log("removed %d dependencies from %s", len(unused), dms3gx.PkgFileName)
+		return nil
+	},
+}
+
+// unusedDeps returns the dependencies of pkg, located in dir, that none of
+// its go files import.
+func unusedDeps(pkg *Package, dir string) ([]*dms3gx.Dependency, error) {
+	imps, _, err := rw.ListImports(dir, goFileFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	pkgdir := filepath.Join(dir, vendorDir)
+
+	var unused []*dms3gx.Dependency
+	for _, dep := range pkg.Dependencies {
+		m := new(rw.PrefixMap)
+		m.Add(dms3gxImport(dep.Hash, dep.Name), "")
+
+		// without the package we can only match its hash path
+		cpkg, err := loadDep(dep, pkgdir)
+		if err != nil {
+			Error("cannot load %s (%s), only looking for its hash path: %s", dep.Name, dep.Hash, err)
+		} else if cpkg.Dms3Gx.DvcsImport != "" {
+			m.Add(cpkg.Dms3Gx.DvcsImport, "")
+		}
+
+		used := false
+		for _, imp := range imps {
+			if !pathIsNotStdlib(imp.Path) && !isDms3gxImport(imp.Path) {
+				continue
+			}
+			if _, _, ok := m.Match(imp.Path); ok {
+				used = true
+				break
+			}
+		}
+
+		if !used {
+			unused = append(unused, dep)
+		}
+	}
+
+	return unused, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	cli "github.com/codegangsta/cli"
+	rw "github.com/dms3-why/dms3gx-go/rewrite"
+)
+
+// stop listing paths to a package after this many
+const maxWhyPaths = 100
+
+var WhyCommand = cli.Command{
+	Name:      "why",
+	Usage:     "explain how a dependency enters the dependency tree",
+	ArgsUsage: "<name|hash|dvcsimport>",
+	Description: `prints every chain of dependencies leading from the current package to
+the given one. Each package in a chain is followed by the source files
+importing the next one.`,
+	Action: func(c *cli.Context) error {
+		if !c.Args().Present() {
+			return fmt.Errorf("must specify a package name, hash or dvcs import path")
+		}
+		ref := c.Args().First()
+
+		g, err := loadRootDepGraph()
+		if err != nil {
+			return err
+		}
+
+		var targets []*depNode
+		for _, n := range g.sortedNodes() {
+			if n.Hash == ref || n.Name == ref || n.DvcsImport == ref {
+				targets = append(targets, n)
+			}
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("%s is not a dependency of %s", ref, g.Root.Name)
+		}
+
+		for i, t := range targets {
+			if i > 0 {
+				fmt.Println()
+			}
+			g.writeWhy(os.Stdout, t)
+		}
+		return nil
+	},
+}
+
+// depPaths returns the chains of dependencies leading from the root to
+// target, at most max of them. Only packages target can be reached from are
+// walked, so the search stops soon after finding max paths however many
+// other paths the graph has.
+func (g *depGraph) depPaths(target *depNode, max int) [][]*depNode {
+	reaches := g.reaching(target)
+
+	var paths [][]*depNode
+	onpath := make(map[*depNode]bool)
+
+	var walk func(path []*depNode)
+	walk = func(path []*depNode) {
+		if len(paths) >= max {
+			return
+		}
+
+		n := path[len(path)-1]
+		if n == target {
+			paths = append(paths, append([]*depNode(nil), path...))
+			return
+		}
+
+		onpath[n] = true
+		for _, h := range n.Deps {
+			if c := g.Nodes[h]; reaches[c] && !onpath[c] {
+				walk(append(path, c))
+			}
+		}
+		onpath[n] = false
+	}
+	if reaches[g.Root] {
+		walk([]*depNode{g.Root})
+	}
+
+	return paths
+}
+
+// reaching returns the packages, the root included, that target can be
+// reached from by following dependencies, target itself included.
+func (g *depGraph) reaching(target *depNode) map[*depNode]bool {
+	dependents := make(map[string][]*depNode)
+	for _, n := range append([]*depNode{g.Root}, g.sortedNodes()...) {
+		for _, h := range n.Deps {
+			dependents[h] = append(dependents[h], n)
+		}
+	}
+
+	reaches := map[*depNode]bool{target: true}
+	queue := []*depNode{target}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, d := range dependents[n.Hash] {
+			if !reaches[d] {
+				reaches[d] = true
+				queue = append(queue, d)
+			}
+		}
+	}
+	return reaches
+}
+
+// importersOf returns the imports within the package from pointing into the
+// package to, either by its dms3gx or by its dvcs import path.
+func (g *depGraph) importersOf(from, to *depNode) []rw.Import {
+	m := new(rw.PrefixMap)
+	m.Add(dms3gxImport(to.Hash, to.Name), "")
+	if to.DvcsImport != "" {
+		m.Add(to.DvcsImport, "")
+	}
+
+	var out []rw.Import
+	for _, imp := range g.importsOf(from) {
+		if _, _, ok := m.Match(imp.Path); ok {
+			out = append(out, imp)
+		}
+	}
+	return out
+}
+
+func (g *depGraph) writeWhy(w io.Writer, target *depNode) {
+	paths := g.depPaths(target, maxWhyPaths)
+
+	fmt.Fprintf(w, "%s is required through %d path(s):\n", target, len(paths))
+	for i, path := range paths {
+		fmt.Fprintf(w, "\n  path %d:\n", i+1)
+		for j, n := range path {
+			fmt.Fprintf(w, "    %s\n", n)
+			if j == len(path)-1 {
+				break
+			}
+
+			imps := g.importersOf(n, path[j+1])
+			if len(imps) == 0 {
+				fmt.Fprintf(w, "      (no source file imports %s)\n", path[j+1].Name)
+			}
+			for _, imp := range imps {
+				fmt.Fprintf(w, "      %s:%d: %s\n", imp.File, imp.Pos.Line, imp.Path)
+			}
+		}
+	}
+
+	if len(paths) == maxWhyPaths {
+		fmt.Fprintf(w, "\n  (stopped after %d paths)\n", maxWhyPaths)
+	}
+}